@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"gosh/internal/alias"
+	"gosh/internal/glob"
 	"gosh/internal/history"
 	"sort"
 )
@@ -57,7 +58,7 @@ func (m *Manager) Initialize() error {
     m.suggestions["cd"] = []string{"../", "./"}
     m.suggestions["git"] = []string{"status", "commit", "push", "pull", "checkout", "branch"}
     
-    m.customComps["cd"] = m.completePath
+    m.customComps["cd"] = m.completeArgPath
     m.customComps["git"] = m.completeGit
 
     return nil
@@ -140,14 +141,24 @@ func (m *Manager) completePath(prefix string) []string {
 			searchPrefix = filepath.Base(prefix)
 	}
 
-	files, err := ioutil.ReadDir(basePath)
+	dir := basePath
+	if !filepath.IsAbs(dir) {
+			dir = filepath.Join(m.shell.GetWorkDir(), dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 			return completions
 	}
 
+	if !glob.HasMeta(searchPrefix) {
+			searchPrefix = glob.QuoteMeta(searchPrefix)
+	}
+	pattern := glob.Compile(searchPrefix + "*")
+
 	for _, file := range files {
 			name := file.Name()
-			if strings.HasPrefix(name, searchPrefix) {
+			if pattern.Match(name) {
 					if file.IsDir() {
 							name += "/"
 					}
@@ -161,6 +172,13 @@ func (m *Manager) completePath(prefix string) []string {
 	return completions
 }
 
+func (m *Manager) completeArgPath(args []string) []string {
+	if len(args) == 0 {
+			return m.completePath("")
+	}
+	return m.completePath(args[len(args)-1])
+}
+
 func (m *Manager) completeGit(args []string) []string {
 	if len(args) == 0 {
 			return m.suggestions["git"]
@@ -0,0 +1,174 @@
+package glob
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Options struct {
+	// DotGlob lets patterns match names starting with '.'.
+	DotGlob bool
+	// GlobStar makes a "**" path component match any number of
+	// directories, including none.
+	GlobStar bool
+}
+
+// Expand returns the sorted pathnames matching pattern. Relative patterns
+// are resolved against dir but returned relative, the way they were written.
+func Expand(pattern, dir string, opts Options) []string {
+	candidates := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		candidates = []string{"/"}
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+
+	components := strings.Split(pattern, "/")
+	needStat := false
+
+	for i, component := range components {
+		last := i == len(components)-1
+		var next []string
+
+		switch {
+		case component == "" && last:
+			// A trailing slash only matches directories.
+			for _, c := range candidates {
+				if isDir(dir, c) {
+					next = append(next, c)
+				}
+			}
+			needStat = false
+
+		case component == "":
+
+		case !HasMeta(component):
+			for _, c := range candidates {
+				next = append(next, join(c, unescape(component)))
+			}
+			needStat = true
+
+		case component == "**" && opts.GlobStar:
+			for _, c := range candidates {
+				next = append(next, walk(dir, c, last, opts)...)
+			}
+			needStat = false
+
+		default:
+			p := Compile(component)
+			dotOK := opts.DotGlob || strings.HasPrefix(component, ".")
+			for _, c := range candidates {
+				entries, err := os.ReadDir(resolve(dir, c))
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					name := entry.Name()
+					if name[0] == '.' && !dotOK {
+						continue
+					}
+					if p.Match(name) {
+						next = append(next, join(c, name))
+					}
+				}
+			}
+			needStat = false
+		}
+
+		if component != "" || last {
+			candidates = next
+		}
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if needStat {
+			if _, err := os.Lstat(resolve(dir, c)); err != nil {
+				continue
+			}
+		}
+		if strings.HasSuffix(pattern, "/") && !strings.HasSuffix(c, "/") {
+			c += "/"
+		}
+		matches = append(matches, c)
+	}
+
+	sort.Strings(matches)
+	return matches
+}
+
+// walk expands a "**" component below prefix. In the middle of a pattern
+// it yields prefix itself and every directory beneath it; at the end it
+// yields every file and directory beneath it. Symbolic links to
+// directories are not followed.
+func walk(dir, prefix string, last bool, opts Options) []string {
+	var found []string
+	if !last {
+		found = append(found, prefix)
+	}
+	return walkDir(dir, prefix, last, opts, found)
+}
+
+func walkDir(dir, prefix string, files bool, opts Options, found []string) []string {
+	entries, err := os.ReadDir(resolve(dir, prefix))
+	if err != nil {
+		return found
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name[0] == '.' && !opts.DotGlob {
+			continue
+		}
+
+		path := join(prefix, name)
+		if entry.IsDir() {
+			found = append(found, path)
+			found = walkDir(dir, path, files, opts, found)
+		} else if files {
+			found = append(found, path)
+		}
+	}
+
+	return found
+}
+
+func join(prefix, name string) string {
+	switch {
+	case prefix == "":
+		return name
+	case strings.HasSuffix(prefix, "/"):
+		return prefix + name
+	}
+	return prefix + "/" + name
+}
+
+func resolve(dir, path string) string {
+	if path == "" {
+		return dir
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func isDir(dir, path string) bool {
+	info, err := os.Stat(resolve(dir, path))
+	return err == nil && info.IsDir()
+}
+
+func unescape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,330 @@
+package glob
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type elemKind int
+
+const (
+	elemLiteral elemKind = iota
+	elemAny
+	elemStar
+	elemClass
+	elemGroup
+)
+
+type elem struct {
+	kind  elemKind
+	r     rune
+	class *charClass
+	group *group
+}
+
+// group is a bash extglob pattern list: ?(..), *(..), +(..), @(..) or !(..).
+type group struct {
+	op   rune
+	alts []*Pattern
+}
+
+type charClass struct {
+	negate bool
+	ranges [][2]rune
+	named  []func(rune) bool
+}
+
+// Pattern is a compiled shell pattern. Unlike path.Match, '*' and '?' also
+// match '/', as required by case and ${var#pattern}.
+type Pattern struct {
+	elems []elem
+}
+
+var namedClasses = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) },
+	"alpha":  unicode.IsLetter,
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  unicode.IsControl,
+	"digit":  unicode.IsDigit,
+	"graph":  func(r rune) bool { return unicode.IsGraphic(r) && !unicode.IsSpace(r) },
+	"lower":  unicode.IsLower,
+	"print":  unicode.IsPrint,
+	"punct":  unicode.IsPunct,
+	"space":  unicode.IsSpace,
+	"upper":  unicode.IsUpper,
+	"xdigit": func(r rune) bool { return strings.ContainsRune("0123456789abcdefABCDEF", r) },
+}
+
+// Compile parses a shell pattern. Malformed brackets match literally, so
+// compiling never fails.
+func Compile(pattern string) *Pattern {
+	p := &Pattern{}
+
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+
+		if strings.ContainsRune("?*+@!", r) && i+1 < len(pattern) && pattern[i+1] == '(' {
+			if g, n := parseGroup(r, pattern[i+2:]); g != nil {
+				p.elems = append(p.elems, elem{kind: elemGroup, group: g})
+				i += 2 + n
+				continue
+			}
+		}
+
+		switch r {
+		case '*':
+			if n := len(p.elems); n == 0 || p.elems[n-1].kind != elemStar {
+				p.elems = append(p.elems, elem{kind: elemStar})
+			}
+		case '?':
+			p.elems = append(p.elems, elem{kind: elemAny})
+		case '[':
+			if class, n := parseClass(pattern[i+1:]); class != nil {
+				p.elems = append(p.elems, elem{kind: elemClass, class: class})
+				i += 1 + n
+				continue
+			}
+			p.elems = append(p.elems, elem{kind: elemLiteral, r: r})
+		case '\\':
+			if i+size < len(pattern) {
+				i += size
+				r, size = utf8.DecodeRuneInString(pattern[i:])
+			}
+			p.elems = append(p.elems, elem{kind: elemLiteral, r: r})
+		default:
+			p.elems = append(p.elems, elem{kind: elemLiteral, r: r})
+		}
+
+		i += size
+	}
+
+	return p
+}
+
+// parseGroup parses the pattern list of an extglob group whose "op(" has
+// been consumed and returns the number of bytes used, including the ')'.
+func parseGroup(op rune, s string) (*group, int) {
+	g := &group{op: op}
+	depth := 0
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case '|', ')':
+			if depth > 0 {
+				if s[i] == ')' {
+					depth--
+				}
+				continue
+			}
+			g.alts = append(g.alts, Compile(s[start:i]))
+			start = i + 1
+			if s[i] == ')' {
+				return g, i + 1
+			}
+		}
+	}
+
+	return nil, 0
+}
+
+// parseClass parses a bracket expression whose '[' has been consumed and
+// returns the number of bytes used, including the closing ']'.
+func parseClass(s string) (*charClass, int) {
+	class := &charClass{}
+	i := 0
+
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		class.negate = true
+		i++
+	}
+
+	first := true
+	for i < len(s) {
+		if s[i] == ']' && !first {
+			return class, i + 1
+		}
+		first = false
+
+		if strings.HasPrefix(s[i:], "[:") {
+			if end := strings.Index(s[i+2:], ":]"); end >= 0 {
+				if fn, ok := namedClasses[s[i+2:i+2+end]]; ok {
+					class.named = append(class.named, fn)
+					i += end + 4
+					continue
+				}
+			}
+		}
+
+		lo, size := utf8.DecodeRuneInString(s[i:])
+		if lo == '\\' && i+size < len(s) {
+			i += size
+			lo, size = utf8.DecodeRuneInString(s[i:])
+		}
+		i += size
+
+		hi := lo
+		if i+1 < len(s) && s[i] == '-' && s[i+1] != ']' {
+			hi, size = utf8.DecodeRuneInString(s[i+1:])
+			i += 1 + size
+		}
+		class.ranges = append(class.ranges, [2]rune{lo, hi})
+	}
+
+	return nil, 0
+}
+
+func (c *charClass) matches(r rune) bool {
+	found := false
+	for _, rg := range c.ranges {
+		if r >= rg[0] && r <= rg[1] {
+			found = true
+			break
+		}
+	}
+	for _, fn := range c.named {
+		if found {
+			break
+		}
+		found = fn(r)
+	}
+	return found != c.negate
+}
+
+func (p *Pattern) Match(name string) bool {
+	return matchElems(p.elems, name)
+}
+
+func matchElems(elems []elem, s string) bool {
+	for len(elems) > 0 {
+		e := elems[0]
+
+		switch e.kind {
+		case elemStar:
+			rest := elems[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchElems(rest, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case elemGroup:
+			return e.group.match(elems, s)
+		}
+
+		if s == "" {
+			return false
+		}
+
+		r, size := utf8.DecodeRuneInString(s)
+		switch e.kind {
+		case elemLiteral:
+			if r != e.r {
+				return false
+			}
+		case elemClass:
+			if !e.class.matches(r) {
+				return false
+			}
+		}
+
+		elems = elems[1:]
+		s = s[size:]
+	}
+
+	return s == ""
+}
+
+func (g *group) matchAny(s string) bool {
+	for _, alt := range g.alts {
+		if alt.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches s against elems, whose first element is g. Repetition is
+// handled by matching the group again against what follows.
+func (g *group) match(elems []elem, s string) bool {
+	rest := elems[1:]
+
+	if (g.op == '?' || g.op == '*') && matchElems(rest, s) {
+		return true
+	}
+
+	for k := 0; k <= len(s); k++ {
+		if k < len(s) && !utf8.RuneStart(s[k]) {
+			continue
+		}
+
+		switch g.op {
+		case '!':
+			if !g.matchAny(s[:k]) && matchElems(rest, s[k:]) {
+				return true
+			}
+
+		case '@', '?':
+			if g.matchAny(s[:k]) && matchElems(rest, s[k:]) {
+				return true
+			}
+
+		case '*', '+':
+			if k == 0 || !g.matchAny(s[:k]) {
+				continue
+			}
+			if matchElems(rest, s[k:]) {
+				return true
+			}
+			again := append([]elem{{kind: elemGroup, group: &group{op: '*', alts: g.alts}}}, rest...)
+			if matchElems(again, s[k:]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func Match(pattern, name string) bool {
+	return Compile(pattern).Match(name)
+}
+
+// QuoteMeta escapes the pattern characters in s so that it matches itself.
+func QuoteMeta(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`\*?[]()|`, s[i]) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// HasMeta reports whether pattern contains any unescaped pattern
+// characters, that is, whether it needs to be matched at all.
+func HasMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		case '+', '@', '!':
+			if i+1 < len(pattern) && pattern[i+1] == '(' {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,6 +1,10 @@
 package job
 
 import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
     "sync"
 )
 
@@ -12,28 +16,49 @@ const (
     StatusDone
 )
 
+// Job is a pipeline the shell started. Command is its text as typed, Pid
+// the process ID of its last process and ExitCode its status once done.
+// NoHup marks a job that is not sent SIGHUP when the shell is hung up.
 type Job struct {
+    Id          int
     Command     string
     Pid         int
     Status      Status
     Background  bool
     ProcessGroup int
+    ExitCode    int
+    NoHup       bool
+
+    // removed marks a job dropped from the table that has not finished.
+    // It keeps its ID until it does, so that the ID is not reused while
+    // its status may still be updated.
+    removed     bool
 }
 
+// Manager is the job table. Job IDs are reused: a new job gets the next
+// ID after the highest one still in the table.
 type Manager struct {
     jobs     map[int]*Job
     mu       sync.RWMutex
     nextJobId int
+
+    // order lists the job IDs from least to most recently started or
+    // stopped; the last is the current job, %+, and the one before it
+    // the previous job, %-.
+    order    []int
+    changed  *sync.Cond
 }
 
 func NewManager() *Manager {
-    return &Manager{
+    m := &Manager{
         jobs: make(map[int]*Job),
         nextJobId: 1,
     }
+    m.changed = sync.NewCond(&m.mu)
+    return m
 }
 
-func (m *Manager) Add(command string, pid int, background bool) int {
+func (m *Manager) Add(command string, pid, pgid int, background bool) int {
     m.mu.Lock()
     defer m.mu.Unlock()
 
@@ -41,28 +66,280 @@ func (m *Manager) Add(command string, pid int, background bool) int {
     m.nextJobId++
 
     m.jobs[jobId] = &Job{
-        Command:    command,
-        Pid:        pid,
-        Status:     StatusRunning,
-        Background: background,
+        Id:           jobId,
+        Command:      command,
+        Pid:          pid,
+        Status:       StatusRunning,
+        Background:   background,
+        ProcessGroup: pgid,
     }
+    m.touch(jobId)
 
     return jobId
 }
 
-func (m *Manager) Get(jobId int) (*Job, bool) {
+// Get returns a copy of the job, which its status may change behind.
+func (m *Manager) Get(jobId int) (Job, bool) {
     m.mu.RLock()
     defer m.mu.RUnlock()
-    
-		job, exists := m.jobs[jobId]
-    return job, exists
+
+		job, exists := m.lookup(jobId)
+    if !exists {
+        return Job{}, false
+    }
+    return *job, true
 }
 
+// UpdateStatus sets the status of the job. A job that stops becomes the
+// current job; one that is done stays so.
 func (m *Manager) UpdateStatus(jobId int, status Status) {
     m.mu.Lock()
     defer m.mu.Unlock()
-    
-    if job, exists := m.jobs[jobId]; exists {
+
+    if job, exists := m.lookup(jobId); exists && job.Status != StatusDone {
         job.Status = status
+        if status == StatusStopped {
+            m.touch(jobId)
+        }
+        m.changed.Broadcast()
+    }
+}
+
+// SetBackground records whether the job runs in the background. A job
+// moved to the foreground or background becomes the current job.
+func (m *Manager) SetBackground(jobId int, background bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if job, exists := m.lookup(jobId); exists {
+        job.Background = background
+        m.touch(jobId)
+    }
+}
+
+// SetNoHup marks the job not to be sent SIGHUP.
+func (m *Manager) SetNoHup(jobId int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if job, exists := m.lookup(jobId); exists {
+        job.NoHup = true
+    }
+}
+
+// Finish marks the job done with its exit status. A job that was removed
+// meanwhile is dropped for good.
+func (m *Manager) Finish(jobId int, exitCode int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if job, exists := m.jobs[jobId]; exists && job.removed {
+        m.drop(jobId)
+    } else if exists {
+        job.Status = StatusDone
+        job.ExitCode = exitCode
+        m.changed.Broadcast()
+    }
+}
+
+// Remove drops the job from the table. Its ID can be reused once it has
+// finished.
+func (m *Manager) Remove(jobId int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    job, exists := m.lookup(jobId)
+    if !exists {
+        return
+    }
+
+    for i, id := range m.order {
+        if id == jobId {
+            m.order = append(m.order[:i], m.order[i+1:]...)
+            break
+        }
+    }
+
+    if job.Status == StatusDone {
+        m.drop(jobId)
+    } else {
+        job.removed = true
+    }
+    m.changed.Broadcast()
+}
+
+// drop deletes the job and makes the next ID the one after the highest in
+// use. The caller holds m.mu.
+func (m *Manager) drop(jobId int) {
+    delete(m.jobs, jobId)
+
+    m.nextJobId = 1
+    for id := range m.jobs {
+        if id >= m.nextJobId {
+            m.nextJobId = id + 1
+        }
+    }
+}
+
+// lookup returns the job if it is in the table. The caller holds m.mu.
+func (m *Manager) lookup(jobId int) (*Job, bool) {
+    job, exists := m.jobs[jobId]
+    if !exists || job.removed {
+        return nil, false
+    }
+    return job, true
+}
+
+// List returns copies of all jobs, in order of job ID.
+func (m *Manager) List() []Job {
+    return m.filter(func(*Job) bool { return true })
+}
+
+// Done returns copies of the finished jobs, in order of job ID.
+func (m *Manager) Done() []Job {
+    return m.filter(func(job *Job) bool { return job.Status == StatusDone })
+}
+
+func (m *Manager) filter(keep func(*Job) bool) []Job {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    var jobs []Job
+    for _, job := range m.jobs {
+        if !job.removed && keep(job) {
+            jobs = append(jobs, *job)
+        }
+    }
+    sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+    return jobs
+}
+
+// Mark returns the marker the job is listed with: '+' for the current
+// job, '-' for the previous one and ' ' otherwise.
+func (m *Manager) Mark(jobId int) byte {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    switch n := len(m.order); {
+    case n > 0 && m.order[n-1] == jobId:
+        return '+'
+    case n > 1 && m.order[n-2] == jobId:
+        return '-'
+    }
+    return ' '
+}
+
+// WaitStatus blocks until the job has one of the statuses, and returns a
+// copy of it. It returns false at once if the job is not in the table, and
+// when the job is removed while waiting.
+func (m *Manager) WaitStatus(jobId int, statuses ...Status) (Job, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    for {
+        job, exists := m.lookup(jobId)
+        if !exists {
+            return Job{}, false
+        }
+        for _, status := range statuses {
+            if job.Status == status {
+                return *job, true
+            }
+        }
+        m.changed.Wait()
+    }
+}
+
+// WaitAny blocks until one of the jobs is done or stopped, and returns a
+// copy of it. Jobs no longer in the table are ignored; it returns false if
+// none of them is left.
+func (m *Manager) WaitAny(jobIds []int) (Job, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    for {
+        left := false
+        for _, id := range jobIds {
+            job, exists := m.lookup(id)
+            if !exists {
+                continue
+            }
+            if job.Status != StatusRunning {
+                return *job, true
+            }
+            left = true
+        }
+        if !left {
+            return Job{}, false
+        }
+        m.changed.Wait()
+    }
+}
+
+// Lookup resolves a job spec: %n for job n, %+ or %% for the current job,
+// %- for the previous one, %string for the job whose command starts with
+// string and %?string for the job whose command contains it. An empty spec
+// is the current job.
+func (m *Manager) Lookup(spec string) (int, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    name := strings.TrimPrefix(spec, "%")
+    if spec != "" && spec == name {
+        return 0, fmt.Errorf("%s: no such job", spec)
+    }
+
+    switch {
+    case name == "" || name == "+" || name == "%":
+        if len(m.order) > 0 {
+            return m.order[len(m.order)-1], nil
+        }
+        if spec == "" {
+            spec = "current"
+        }
+        return 0, fmt.Errorf("%s: no such job", spec)
+
+    case name == "-":
+        if len(m.order) > 1 {
+            return m.order[len(m.order)-2], nil
+        }
+        return 0, fmt.Errorf("%s: no such job", spec)
+    }
+
+    if id, err := strconv.Atoi(name); err == nil {
+        if _, exists := m.lookup(id); exists {
+            return id, nil
+        }
+        return 0, fmt.Errorf("%s: no such job", spec)
+    }
+
+    match := func(job *Job) bool { return strings.HasPrefix(job.Command, name) }
+    if sub, ok := strings.CutPrefix(name, "?"); ok {
+        match = func(job *Job) bool { return strings.Contains(job.Command, sub) }
+    }
+
+    found := 0
+    for id, job := range m.jobs {
+        if !job.removed && match(job) {
+            if found != 0 {
+                return 0, fmt.Errorf("%s: ambiguous job spec", spec)
+            }
+            found = id
+        }
+    }
+    if found == 0 {
+        return 0, fmt.Errorf("%s: no such job", spec)
+    }
+    return found, nil
+}
+
+// touch makes the job the current one. The caller holds m.mu.
+func (m *Manager) touch(jobId int) {
+    for i, id := range m.order {
+        if id == jobId {
+            m.order = append(m.order[:i], m.order[i+1:]...)
+            break
+        }
     }
+    m.order = append(m.order, jobId)
 }
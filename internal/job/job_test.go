@@ -0,0 +1,63 @@
+package job
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	m := NewManager()
+	m.Add("sleep 10", 100, 100, true)
+	m.Add("make all", 101, 101, true)
+	m.Add("sleep 20", 102, 102, true)
+
+	tests := []struct {
+		spec string
+		want int
+		err  string
+	}{
+		{"", 3, ""},
+		{"%+", 3, ""},
+		{"%%", 3, ""},
+		{"%-", 2, ""},
+		{"%1", 1, ""},
+		{"%make", 2, ""},
+		{"%?all", 2, ""},
+		{"%sleep", 0, "ambiguous job spec"},
+		{"%4", 0, "no such job"},
+		{"%vi", 0, "no such job"},
+		{"1", 0, "no such job"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := m.Lookup(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Lookup(%q) error = %v, want one containing %q", tt.spec, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Lookup(%q) = %d, %v, want %d", tt.spec, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveKeepsIdUntilFinished(t *testing.T) {
+	m := NewManager()
+	first := m.Add("sleep 10", 100, 100, true)
+
+	m.Remove(first)
+	if id := m.Add("sleep 20", 101, 101, true); id == first {
+		t.Fatalf("running removed job's ID %d was reused", id)
+	}
+
+	m.Finish(first, 0)
+	m.Finish(2, 0)
+	m.Remove(2)
+	if id := m.Add("sleep 30", 102, 102, true); id != first {
+		t.Errorf("new job got ID %d, want %d once the removed job finished", id, first)
+	}
+}
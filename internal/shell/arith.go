@@ -0,0 +1,629 @@
+package shell
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// arithOperators lists the arithmetic operators, longest first where one is
+// a prefix of another.
+var arithOperators = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "^", "|", "!", "~", "?", ":", "=", ",", "(", ")",
+}
+
+// binaryPrecedence gives the precedence of the left-associative binary
+// operators; higher binds tighter. Assignment, ?: and ** are handled
+// separately because they associate to the right.
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+var assignOperators = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, "&=": true, "^=": true, "|=": true,
+}
+
+// arithToken is an operator, a number, or a variable name with the
+// subscript of an array element if indexed is set.
+type arithToken struct {
+	op      string
+	name    string
+	index   string
+	indexed bool
+	num     int64
+	pos     int
+}
+
+// arithNode is a parsed arithmetic expression. Expressions are parsed in
+// full before evaluation so that the unevaluated operands of &&, || and ?:
+// have no side effects.
+type arithNode struct {
+	op      string
+	name    string
+	index   string
+	indexed bool
+	num     int64
+	x, y, z *arithNode
+	pos     int
+	postfix bool
+}
+
+// varNode returns a node for the variable tok refers to, performing op.
+func varNode(op string, tok arithToken) *arithNode {
+	return &arithNode{op: op, name: tok.name, index: tok.index, indexed: tok.indexed, pos: tok.pos}
+}
+
+type arithParser struct {
+	expr   string
+	tokens []arithToken
+	pos    int
+}
+
+// arith evaluates an arithmetic expression. Variables may be referenced by
+// name without '$'; unset and empty variables are zero.
+func (s *Shell) arith(expr string) (int64, error) {
+	return s.arithDepth(expr, 0)
+}
+
+func (s *Shell) arithDepth(expr string, depth int) (int64, error) {
+	if depth > 64 {
+		return 0, &ParseError{Message: "expression recursion level exceeded", Pos: 0}
+	}
+
+	tokens, err := arithTokenize(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	ap := &arithParser{expr: expr, tokens: tokens}
+	node, err := ap.parseComma()
+	if err != nil {
+		return 0, err
+	}
+	if ap.pos < len(ap.tokens) {
+		return 0, ap.unexpected()
+	}
+
+	return s.arithEval(node, depth)
+}
+
+func arithTokenize(expr string) ([]arithToken, error) {
+	var tokens []arithToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(expr) && (isAlphaNumeric(rune(expr[j])) || strings.IndexByte("_#@", expr[j]) >= 0) {
+				j++
+			}
+			n, err := parseArithNumber(expr[i:j])
+			if err != nil {
+				return nil, &ParseError{Message: err.Error(), Pos: i}
+			}
+			tokens = append(tokens, arithToken{num: n, pos: i})
+			i = j
+
+		case isAlpha(rune(c)) || c == '_':
+			tok := arithToken{name: extractVariableName(expr[i:]), pos: i}
+			i += len(tok.name)
+
+			if end := closingBracket(expr[i:]); end > 0 {
+				tok.index, tok.indexed = expr[i+1:i+end], true
+				i += end + 1
+			}
+			tokens = append(tokens, tok)
+
+		default:
+			found := false
+			for _, op := range arithOperators {
+				if strings.HasPrefix(expr[i:], op) {
+					tokens = append(tokens, arithToken{op: op, pos: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, &ParseError{Message: "invalid arithmetic operator '" + string(c) + "'", Pos: i}
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// parseArithNumber parses a decimal, 0x hexadecimal or 0 octal constant,
+// or one written base#digits for a base from 2 to 64. Above base 36 the
+// digits after 9 are a-z, A-Z, @ and _; below, letters of either case
+// stand for 10 to 35.
+func parseArithNumber(s string) (int64, error) {
+	base, digits := 10, s
+	switch {
+	case strings.Contains(s, "#"):
+		prefix, rest, _ := strings.Cut(s, "#")
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 2 || n > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base '%s'", prefix)
+		}
+		base, digits = n, rest
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base, digits = 16, s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base, digits = 8, s[1:]
+	}
+	if digits == "" {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+
+	var n int64
+	for i := 0; i < len(digits); i++ {
+		d := digitValue(digits[i], base)
+		if d < 0 || d >= base {
+			return 0, fmt.Errorf("value too great for base '%s'", s)
+		}
+		if n > (math.MaxInt64-int64(d))/int64(base) {
+			return 0, fmt.Errorf("integer overflow '%s'", s)
+		}
+		n = n*int64(base) + int64(d)
+	}
+	return n, nil
+}
+
+func digitValue(c byte, base int) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'Z' && base <= 36:
+		return int(c-'A') + 10
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 36
+	case c == '@':
+		return 62
+	case c == '_':
+		return 63
+	}
+	return -1
+}
+
+func (ap *arithParser) peek() (arithToken, bool) {
+	if ap.pos >= len(ap.tokens) {
+		return arithToken{}, false
+	}
+	return ap.tokens[ap.pos], true
+}
+
+// peekOp returns the operator at the cursor, or "" if there is none.
+func (ap *arithParser) peekOp() string {
+	tok, ok := ap.peek()
+	if !ok {
+		return ""
+	}
+	return tok.op
+}
+
+func (ap *arithParser) unexpected() error {
+	tok, ok := ap.peek()
+	if !ok {
+		return &ParseError{Message: "syntax error: operand expected", Pos: len(ap.expr)}
+	}
+	return &ParseError{Message: "syntax error in expression", Pos: tok.pos}
+}
+
+func (ap *arithParser) parseComma() (*arithNode, error) {
+	x, err := ap.parseAssign()
+	if err != nil {
+		return nil, err
+	}
+
+	for ap.peekOp() == "," {
+		pos := ap.tokens[ap.pos].pos
+		ap.pos++
+		y, err := ap.parseAssign()
+		if err != nil {
+			return nil, err
+		}
+		x = &arithNode{op: ",", x: x, y: y, pos: pos}
+	}
+	return x, nil
+}
+
+func (ap *arithParser) parseAssign() (*arithNode, error) {
+	tok, ok := ap.peek()
+	if ok && tok.name != "" && ap.pos+1 < len(ap.tokens) {
+		if op := ap.tokens[ap.pos+1].op; assignOperators[op] {
+			ap.pos += 2
+			y, err := ap.parseAssign()
+			if err != nil {
+				return nil, err
+			}
+			node := varNode(op, tok)
+			node.y = y
+			return node, nil
+		}
+	}
+
+	return ap.parseTernary()
+}
+
+func (ap *arithParser) parseTernary() (*arithNode, error) {
+	cond, err := ap.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if ap.peekOp() != "?" {
+		return cond, nil
+	}
+	pos := ap.tokens[ap.pos].pos
+	ap.pos++
+
+	x, err := ap.parseAssign()
+	if err != nil {
+		return nil, err
+	}
+	if ap.peekOp() != ":" {
+		return nil, ap.unexpected()
+	}
+	ap.pos++
+
+	y, err := ap.parseAssign()
+	if err != nil {
+		return nil, err
+	}
+	return &arithNode{op: "?", x: cond, y: x, z: y, pos: pos}, nil
+}
+
+// parseBinary parses the left-associative binary operators binding at
+// least as tightly as prec.
+func (ap *arithParser) parseBinary(prec int) (*arithNode, error) {
+	x, err := ap.parsePower()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := ap.peekOp()
+		p := binaryPrecedence[op]
+		if p == 0 || p < prec {
+			return x, nil
+		}
+		pos := ap.tokens[ap.pos].pos
+		ap.pos++
+
+		y, err := ap.parseBinary(p + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &arithNode{op: op, x: x, y: y, pos: pos}
+	}
+}
+
+func (ap *arithParser) parsePower() (*arithNode, error) {
+	x, err := ap.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if ap.peekOp() != "**" {
+		return x, nil
+	}
+	pos := ap.tokens[ap.pos].pos
+	ap.pos++
+
+	y, err := ap.parsePower()
+	if err != nil {
+		return nil, err
+	}
+	return &arithNode{op: "**", x: x, y: y, pos: pos}, nil
+}
+
+func (ap *arithParser) parseUnary() (*arithNode, error) {
+	tok, ok := ap.peek()
+	if !ok {
+		return nil, ap.unexpected()
+	}
+
+	switch tok.op {
+	case "++", "--":
+		ap.pos++
+		name, ok := ap.peek()
+		if !ok || name.name == "" {
+			return nil, ap.unexpected()
+		}
+		ap.pos++
+		node := varNode(tok.op, name)
+		node.pos = tok.pos
+		return node, nil
+
+	case "+", "-", "!", "~":
+		ap.pos++
+		x, err := ap.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &arithNode{op: "u" + tok.op, x: x, pos: tok.pos}, nil
+	}
+
+	return ap.parsePostfix()
+}
+
+func (ap *arithParser) parsePostfix() (*arithNode, error) {
+	tok, _ := ap.peek()
+	ap.pos++
+
+	switch {
+	case tok.op == "(":
+		x, err := ap.parseComma()
+		if err != nil {
+			return nil, err
+		}
+		if ap.peekOp() != ")" {
+			return nil, ap.unexpected()
+		}
+		ap.pos++
+		return x, nil
+
+	case tok.name != "":
+		if op := ap.peekOp(); op == "++" || op == "--" {
+			ap.pos++
+			node := varNode(op, tok)
+			node.postfix = true
+			return node, nil
+		}
+		return varNode("", tok), nil
+
+	case tok.op == "":
+		return &arithNode{num: tok.num, pos: tok.pos}, nil
+	}
+
+	ap.pos--
+	return nil, ap.unexpected()
+}
+
+// arithVar returns the value of the variable or array element node refers
+// to, evaluating its contents as an expression in turn.
+func (s *Shell) arithVar(node *arithNode, depth int) (int64, error) {
+	value, _ := s.lookupVar(node.name)
+	if node.indexed {
+		var err error
+		if value, _, err = s.lookupElem(node.name, node.index); err != nil {
+			return 0, err
+		}
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	return s.arithDepth(value, depth+1)
+}
+
+func (s *Shell) arithAssign(node *arithNode, value int64) (int64, error) {
+	if node.indexed {
+		return value, s.setElem(node.name, node.index, strconv.FormatInt(value, 10), false)
+	}
+	return value, s.setVar(node.name, strconv.FormatInt(value, 10))
+}
+
+func (s *Shell) arithEval(node *arithNode, depth int) (int64, error) {
+	switch {
+	case node.op == "" && node.name == "":
+		return node.num, nil
+
+	case node.op == "":
+		return s.arithVar(node, depth)
+
+	case node.op == "++" || node.op == "--":
+		old, err := s.arithVar(node, depth)
+		if err != nil {
+			return 0, err
+		}
+		value, err := arithBinary(node.op[:1], old, 1, node.pos)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.arithAssign(node, value); err != nil {
+			return 0, err
+		}
+		if node.postfix {
+			return old, nil
+		}
+		return value, nil
+
+	case node.op == "=":
+		value, err := s.arithEval(node.y, depth)
+		if err != nil {
+			return 0, err
+		}
+		return s.arithAssign(node, value)
+
+	case node.name != "":
+		// A compound assignment such as +=.
+		old, err := s.arithVar(node, depth)
+		if err != nil {
+			return 0, err
+		}
+		y, err := s.arithEval(node.y, depth)
+		if err != nil {
+			return 0, err
+		}
+		value, err := arithBinary(strings.TrimSuffix(node.op, "="), old, y, node.pos)
+		if err != nil {
+			return 0, err
+		}
+		return s.arithAssign(node, value)
+
+	case strings.HasPrefix(node.op, "u"):
+		x, err := s.arithEval(node.x, depth)
+		if err != nil {
+			return 0, err
+		}
+		switch node.op {
+		case "u-":
+			return arithBinary("-", 0, x, node.pos)
+		case "u!":
+			return boolInt(x == 0), nil
+		case "u~":
+			return ^x, nil
+		}
+		return x, nil
+
+	case node.op == "?":
+		cond, err := s.arithEval(node.x, depth)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return s.arithEval(node.y, depth)
+		}
+		return s.arithEval(node.z, depth)
+
+	case node.op == "&&" || node.op == "||":
+		x, err := s.arithEval(node.x, depth)
+		if err != nil {
+			return 0, err
+		}
+		if (x != 0) == (node.op == "||") {
+			return boolInt(x != 0), nil
+		}
+		y, err := s.arithEval(node.y, depth)
+		if err != nil {
+			return 0, err
+		}
+		return boolInt(y != 0), nil
+	}
+
+	x, err := s.arithEval(node.x, depth)
+	if err != nil {
+		return 0, err
+	}
+	y, err := s.arithEval(node.y, depth)
+	if err != nil {
+		return 0, err
+	}
+	if node.op == "," {
+		return y, nil
+	}
+	return arithBinary(node.op, x, y, node.pos)
+}
+
+// arithBinary applies a binary operator. Results that do not fit in 64
+// bits are reported as overflow rather than wrapping around.
+func arithBinary(op string, x, y int64, pos int) (int64, error) {
+	overflow := &ParseError{Message: "integer overflow", Pos: pos}
+
+	switch op {
+	case "+":
+		if (y > 0 && x > math.MaxInt64-y) || (y < 0 && x < math.MinInt64-y) {
+			return 0, overflow
+		}
+		return x + y, nil
+	case "-":
+		if (y < 0 && x > math.MaxInt64+y) || (y > 0 && x < math.MinInt64+y) {
+			return 0, overflow
+		}
+		return x - y, nil
+	case "*":
+		result, ok := mulInt64(x, y)
+		if !ok {
+			return 0, overflow
+		}
+		return result, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, &ParseError{Message: "division by 0", Pos: pos}
+		}
+		if op == "%" {
+			return x % y, nil
+		}
+		if x == math.MinInt64 && y == -1 {
+			return 0, overflow
+		}
+		return x / y, nil
+	case "**":
+		if y < 0 {
+			return 0, &ParseError{Message: "exponent less than 0", Pos: pos}
+		}
+		result, ok := int64(1), true
+		for ; y > 0 && ok; y >>= 1 {
+			if y&1 != 0 {
+				result, ok = mulInt64(result, x)
+			}
+			if y > 1 && ok {
+				x, ok = mulInt64(x, x)
+			}
+		}
+		if !ok {
+			return 0, overflow
+		}
+		return result, nil
+	case "<<":
+		return x << uint64(y&63), nil
+	case ">>":
+		return x >> uint64(y&63), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	case "<":
+		return boolInt(x < y), nil
+	case ">":
+		return boolInt(x > y), nil
+	case "<=":
+		return boolInt(x <= y), nil
+	case ">=":
+		return boolInt(x >= y), nil
+	case "==":
+		return boolInt(x == y), nil
+	case "!=":
+		return boolInt(x != y), nil
+	}
+	return 0, &ParseError{Message: "invalid operator '" + op + "'", Pos: pos}
+}
+
+// mulInt64 multiplies x and y, reporting false if the product overflows.
+func mulInt64(x, y int64) (int64, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	result := x * y
+	if result/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return 0, false
+	}
+	return result, true
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package shell
+
+import "testing"
+
+func TestArithmetic(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "precedence", script: "echo $((1 + 2 * 3)) $(((1 + 2) * 3)) $((2 ** 3 ** 2))", want: "7 9 512\n"},
+		{name: "variables", script: "x=4; echo $((x * 2)) $((y + 1))", want: "8 1\n"},
+		{name: "assignment", script: "x=1; echo $((x += 2)) $((x++)) $x", want: "3 3 4\n"},
+		{name: "ternary", script: "x=0; echo $((x ? 1 : 2))", want: "2\n"},
+		{name: "bases", script: "echo $((16#ff)) $((0x10)) $((010))", want: "255 16 8\n"},
+		{name: "command", script: "x=1; (( x > 0 )) && echo yes; (( x - 1 )) || echo no", want: "yes\nno\n"},
+		{name: "let", script: "let x=2*3 y=x+1; echo $x $y", want: "6 7\n"},
+		{name: "division by zero", script: "echo $((1 / 0))", want: "Error: parse error at position 2: division by 0\n", status: 1},
+	})
+}
+
+func TestArithmeticSubstring(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "variable offset", script: "x=abcdef n=1; echo ${x:n}", want: "bcdef\n"},
+		{name: "expression offset", script: "x=abcdef; echo ${x:1+1}", want: "cdef\n"},
+		{name: "expression length", script: "x=abcdef n=1; echo ${x:n:n*2}", want: "bc\n"},
+		{name: "empty offset", script: "x=abcdef; echo ${x::2}", want: "ab\n"},
+		{name: "array slice", script: "a=(a b c d); n=1; echo ${a[@]:n:2}", want: "b c\n"},
+	})
+}
@@ -0,0 +1,232 @@
+package shell
+
+// Node is implemented by every element of the syntax tree produced by Parser.
+type Node interface {
+	node()
+}
+
+// List is a sequence of and-or chains separated by ';' or '&'.
+type List struct {
+	Items []*AndOr
+}
+
+// AndOr is a chain of pipelines joined by && or ||. Ops[i] joins
+// Pipelines[i] and Pipelines[i+1]. Background marks a trailing '&', and
+// Source is the text of the chain, which the job table shows.
+type AndOr struct {
+	Pipelines  []*Pipeline
+	Ops        []TokenType
+	Background bool
+	Source     string
+}
+
+// Pipeline is a sequence of commands joined by '|'. Negated marks a
+// leading '!', which inverts its status.
+type Pipeline struct {
+	Commands []Node
+	Negated  bool
+}
+
+// Command is a simple command. Assigns, Words and Redirects come from the
+// parser; Args and Env hold the expanded argument vector and environment
+// handed to the Executor. Internal is set for a pipeline stage that runs in
+// the shell, such as a builtin, a function or a compound command; the
+// Executor calls it in a subshell connected to the neighbouring stages.
+type Command struct {
+	Assigns   []*Assign
+	Words     []*Word
+	Redirects []*Redirect
+	Args      []string
+	Env       []string
+	Dir       string
+	Internal  func(sub *Shell) error
+}
+
+// Assign is a NAME=value word before the command name. Without a command
+// it sets a shell variable; otherwise it only affects the command. Index
+// is the subscript of NAME[index]=value, Append marks +=, and Array holds
+// the elements of NAME=(...), in which case Value is nil.
+type Assign struct {
+	Name   string
+	Index  *Word
+	Append bool
+	Value  *Word
+	Array  []*ArrayElem
+}
+
+// ArrayElem is one element of an array assignment, either value or
+// [index]=value.
+type ArrayElem struct {
+	Index *Word
+	Value *Word
+}
+
+// IfClause is if/then/else/fi. Else is nil, a *List for else, or an
+// *IfClause for elif.
+type IfClause struct {
+	Cond *List
+	Then *List
+	Else Node
+}
+
+// ForClause is "for Name in Words; do Body; done". Without in, the loop
+// runs over the positional parameters.
+type ForClause struct {
+	Name  string
+	In    bool
+	Words []*Word
+	Body  *List
+}
+
+// ArithForClause is "for ((Init; Cond; Post)); do Body; done". An empty
+// Cond is true. The expressions are expanded before each evaluation.
+type ArithForClause struct {
+	Init *Word
+	Cond *Word
+	Post *Word
+	Body *List
+}
+
+// ArithCommand is "(( Expr ))", which succeeds when Expr is non-zero.
+type ArithCommand struct {
+	Expr *Word
+}
+
+// WhileClause is a while loop, or an until loop when Until is set.
+type WhileClause struct {
+	Cond  *List
+	Body  *List
+	Until bool
+}
+
+// CaseClause is "case Word in ... esac".
+type CaseClause struct {
+	Word  *Word
+	Items []*CaseItem
+}
+
+// CaseItem is one "patterns) body" arm of a case. Op is its terminator:
+// ;; ends the case, ;& runs the next body without testing its patterns
+// and ;;& goes on testing the following patterns.
+type CaseItem struct {
+	Patterns []*Word
+	Body     *List
+	Op       TokenType
+}
+
+// Block is a brace group, "{ List; }", run in the current shell.
+type Block struct {
+	List *List
+}
+
+// Subshell is "( List )", run in a copy of the shell so that changes to
+// its state do not outlive it.
+type Subshell struct {
+	List *List
+}
+
+// Redirected is a compound command followed by redirections, which apply
+// to every command inside it.
+type Redirected struct {
+	Command   Node
+	Redirects []*Redirect
+}
+
+// FuncDecl defines a function. Source is the text of the definition, which
+// is what declare -f prints.
+type FuncDecl struct {
+	Name   string
+	Body   Node
+	Source string
+}
+
+// Redirect redirects file descriptor Fd. For the duplicating operators >&
+// and <& the target is a descriptor number or "-" to close Fd; &> and &>>
+// redirect both stdout and stderr.
+type Redirect struct {
+	Op     TokenType
+	Fd     int
+	Target *Word
+}
+
+// Word is a single shell word made of one or more parts that are expanded
+// and concatenated at execution time.
+type Word struct {
+	Parts []WordPart
+}
+
+type WordPart interface {
+	wordPart()
+}
+
+// Lit is literal text; outside DblQuoted it is unquoted.
+type Lit struct {
+	Value string
+}
+
+// SglQuoted is literal text that was quoted with single quotes or escaped
+// with a backslash.
+type SglQuoted struct {
+	Value string
+}
+
+// DblQuoted holds the parts of a double-quoted string. They are expanded
+// but never split or globbed.
+type DblQuoted struct {
+	Parts []WordPart
+}
+
+// ParamExp is $name or ${...}. Op is the operator following the name, if
+// any, and Arg its word, pattern or offset. Repl is the replacement of
+// ${name/pat/rep} or the length of ${name:off:len}. Length marks ${#name}.
+// Index is the subscript of ${name[index]}, and Keys marks ${!name[@]}.
+type ParamExp struct {
+	Name   string
+	Index  *Word
+	Length bool
+	Keys   bool
+	Op     string
+	Arg    *Word
+	Repl   *Word
+}
+
+// ProcSubst is <(...), or >(...) with Output set. It is replaced by a path
+// from which the output of List can be read, or to which its input can be
+// written.
+type ProcSubst struct {
+	List   *List
+	Output bool
+}
+
+// ArithExp is $((...)); Expr is expanded and then evaluated.
+type ArithExp struct {
+	Expr *Word
+}
+
+// CmdSubst is $(...) or `...`; its output replaces the part.
+type CmdSubst struct {
+	List *List
+}
+
+func (*List) node()           {}
+func (*AndOr) node()          {}
+func (*Pipeline) node()       {}
+func (*Command) node()        {}
+func (*IfClause) node()       {}
+func (*ForClause) node()      {}
+func (*ArithForClause) node() {}
+func (*ArithCommand) node()   {}
+func (*WhileClause) node()    {}
+func (*CaseClause) node()     {}
+func (*Block) node()          {}
+func (*Subshell) node()       {}
+func (*Redirected) node()     {}
+func (*FuncDecl) node()       {}
+
+func (*Lit) wordPart()       {}
+func (*SglQuoted) wordPart() {}
+func (*DblQuoted) wordPart() {}
+func (*ParamExp) wordPart()  {}
+func (*ArithExp) wordPart()  {}
+func (*CmdSubst) wordPart()  {}
+func (*ProcSubst) wordPart() {}
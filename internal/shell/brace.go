@@ -0,0 +1,222 @@
+package shell
+
+import (
+	"strconv"
+	"strings"
+)
+
+// braceItem is one unit of a word during brace expansion: either a byte of
+// unquoted literal text, the only place braces and commas are special, or
+// an opaque part such as a quoted string or an expansion.
+type braceItem struct {
+	c    byte
+	part WordPart
+}
+
+// expandBraces performs brace expansion on word, returning the words it
+// expands to in order. Words without a valid brace expression are
+// returned unchanged.
+func expandBraces(word *Word) []*Word {
+	var items []braceItem
+	for _, part := range word.Parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			items = append(items, braceItem{part: part})
+			continue
+		}
+		for i := 0; i < len(lit.Value); i++ {
+			items = append(items, braceItem{c: lit.Value[i]})
+		}
+	}
+
+	var words []*Word
+	for _, expanded := range braceExpand(items) {
+		words = append(words, braceWord(expanded))
+	}
+	return words
+}
+
+func braceExpand(items []braceItem) [][]braceItem {
+	for i := range items {
+		if items[i].part != nil || items[i].c != '{' {
+			continue
+		}
+
+		alts, end := braceAlternatives(items, i)
+		if alts == nil {
+			continue
+		}
+
+		var result [][]braceItem
+		for _, alt := range alts {
+			next := make([]braceItem, 0, i+len(alt)+len(items)-end)
+			next = append(next, items[:i]...)
+			next = append(next, alt...)
+			next = append(next, items[end+1:]...)
+			result = append(result, braceExpand(next)...)
+		}
+		return result
+	}
+
+	return [][]braceItem{items}
+}
+
+// braceAlternatives parses the brace expression opening at items[open]
+// and returns its alternatives and the index of the closing brace, or nil
+// if the braces do not form a comma list or a sequence.
+func braceAlternatives(items []braceItem, open int) ([][]braceItem, int) {
+	depth := 0
+	start := open + 1
+	var alts [][]braceItem
+
+	for i := open + 1; i < len(items); i++ {
+		if items[i].part != nil {
+			continue
+		}
+
+		switch items[i].c {
+		case '{':
+			depth++
+		case ',':
+			if depth == 0 {
+				alts = append(alts, items[start:i])
+				start = i + 1
+			}
+		case '}':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if alts != nil {
+				return append(alts, items[start:i]), i
+			}
+			if seq := braceSequence(items[open+1 : i]); seq != nil {
+				return seq, i
+			}
+			return nil, 0
+		}
+	}
+
+	return nil, 0
+}
+
+// braceSequence expands the body of {x..y[..incr]}, where x and y are
+// both integers or both single characters. Integers are zero-padded to a
+// common width when either end has a leading zero.
+func braceSequence(items []braceItem) [][]braceItem {
+	var sb strings.Builder
+	for _, item := range items {
+		if item.part != nil {
+			return nil
+		}
+		sb.WriteByte(item.c)
+	}
+
+	fields := strings.Split(sb.String(), "..")
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil
+	}
+
+	incr := 1
+	if len(fields) == 3 {
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil
+		}
+		if n < 0 {
+			n = -n
+		}
+		if n != 0 {
+			incr = n
+		}
+	}
+
+	var values []string
+	if lo, err := strconv.Atoi(fields[0]); err == nil {
+		hi, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil
+		}
+
+		width := 0
+		if zeroPadded(fields[0]) || zeroPadded(fields[1]) {
+			width = max(len(fields[0]), len(fields[1]))
+		}
+
+		for _, n := range braceRange(lo, hi, incr) {
+			values = append(values, padInt(n, width))
+		}
+	} else {
+		if len(fields[0]) != 1 || len(fields[1]) != 1 || !isAlpha(rune(fields[0][0])) || !isAlpha(rune(fields[1][0])) {
+			return nil
+		}
+		for _, n := range braceRange(int(fields[0][0]), int(fields[1][0]), incr) {
+			values = append(values, string(rune(n)))
+		}
+	}
+
+	seq := make([][]braceItem, len(values))
+	for i, value := range values {
+		seq[i] = []braceItem{{part: &Lit{Value: value}}}
+	}
+	return seq
+}
+
+func braceRange(lo, hi, incr int) []int {
+	var values []int
+	if lo <= hi {
+		for n := lo; n <= hi; n += incr {
+			values = append(values, n)
+		}
+	} else {
+		for n := lo; n >= hi; n -= incr {
+			values = append(values, n)
+		}
+	}
+	return values
+}
+
+func zeroPadded(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0'
+}
+
+func padInt(n, width int) string {
+	digits := strconv.Itoa(n)
+	if n < 0 {
+		digits = digits[1:]
+		width--
+	}
+	if len(digits) < width {
+		digits = strings.Repeat("0", width-len(digits)) + digits
+	}
+	if n < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// braceWord turns items back into a word, joining runs of literal bytes.
+func braceWord(items []braceItem) *Word {
+	word := &Word{}
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			word.Parts = append(word.Parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for _, item := range items {
+		if item.part == nil {
+			lit.WriteByte(item.c)
+			continue
+		}
+		flush()
+		word.Parts = append(word.Parts, item.part)
+	}
+	flush()
+
+	return word
+}
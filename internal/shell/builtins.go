@@ -1,19 +1,42 @@
 package shell
 
 import (
+    "errors"
     "fmt"
+    "io"
     "os"
+    "path/filepath"
     "sort"
+    "strconv"
     "strings"
+    "syscall"
+
+    "gosh/internal/job"
 )
 
+// BuiltinCommand is a command run by the shell itself. Execute is given the
+// command's standard streams, with its redirections applied; in a pipeline
+// they are the ends of the stage's pipes.
 type BuiltinCommand struct {
     Name        		string
     Description 		string
-    Execute     		func(s *Shell, args []string) error
+    Execute     		func(s *Shell, st Streams, args []string) error
+}
+
+// Streams are the standard input, output and error of a builtin.
+type Streams struct {
+    Stdin       		io.Reader
+    Stdout      		io.Writer
+    Stderr      		io.Writer
 }
 
-var builtinCommands = map[string]BuiltinCommand{
+var builtinCommands map[string]BuiltinCommand
+
+// builtinCommands is filled in init because several builtins refer back to
+// the table or to Shell.Execute, which would otherwise be an initialization
+// cycle.
+func init() {
+    builtinCommands = map[string]BuiltinCommand{
     "cd": {
         Name:        		"cd",
         Description: 		"Change current directory",
@@ -41,7 +64,7 @@ var builtinCommands = map[string]BuiltinCommand{
     },
     "export": {
         Name:        		"export",
-        Description: 		"Set environment variables",
+        Description: 		"Mark variables for export to commands",
         Execute:     		exportCommand,
     },
     "source": {
@@ -49,39 +72,147 @@ var builtinCommands = map[string]BuiltinCommand{
         Description: 		"Execute commands from a file",
         Execute:     		sourceCommand,
     },
+    "shopt": {
+        Name:        		"shopt",
+        Description: 		"Set and unset shell options",
+        Execute:     		shoptCommand,
+    },
+    "break": {
+        Name:        		"break",
+        Description: 		"Exit from for, while or until loops",
+        Execute:     		breakCommand,
+    },
+    "continue": {
+        Name:        		"continue",
+        Description: 		"Resume the next iteration of a loop",
+        Execute:     		breakCommand,
+    },
+    "return": {
+        Name:        		"return",
+        Description: 		"Return from a function or sourced file",
+        Execute:     		returnCommand,
+    },
+    "local": {
+        Name:        		"local",
+        Description: 		"Declare variables local to a function",
+        Execute:     		localCommand,
+    },
+    "functions": {
+        Name:        		"functions",
+        Description: 		"Display function definitions",
+        Execute:     		functionsCommand,
+    },
+    "declare": {
+        Name:        		"declare",
+        Description: 		"Declare variables and their attributes, or list functions",
+        Execute:     		declareCommand,
+    },
+    "readonly": {
+        Name:        		"readonly",
+        Description: 		"Mark variables as read-only",
+        Execute:     		readonlyCommand,
+    },
+    "unset": {
+        Name:        		"unset",
+        Description: 		"Remove variables, array elements or functions",
+        Execute:     		unsetCommand,
+    },
+    "let": {
+        Name:        		"let",
+        Description: 		"Evaluate arithmetic expressions",
+        Execute:     		letCommand,
+    },
+    "set": {
+        Name:        		"set",
+        Description: 		"Set shell options and positional parameters",
+        Execute:     		setCommand,
+    },
+    "jobs": {
+        Name:        		"jobs",
+        Description: 		"List jobs",
+        Execute:     		jobsCommand,
+    },
+    "fg": {
+        Name:        		"fg",
+        Description: 		"Move a job to the foreground",
+        Execute:     		fgCommand,
+    },
+    "bg": {
+        Name:        		"bg",
+        Description: 		"Continue stopped jobs in the background",
+        Execute:     		bgCommand,
+    },
+    "disown": {
+        Name:        		"disown",
+        Description: 		"Remove jobs from the job table",
+        Execute:     		disownCommand,
+    },
+    "wait": {
+        Name:        		"wait",
+        Description: 		"Wait for jobs to finish",
+        Execute:     		waitCommand,
+    },
+    "read": {
+        Name:        		"read",
+        Description: 		"Read a line from standard input into variables",
+        Execute:     		readCommand,
+    },
+    }
 }
 
-func cdCommand(s *Shell, args []string) error {
+// cdCommand changes the shell's working directory. The process's own
+// directory is left alone so that subshells can have their own.
+func cdCommand(s *Shell, st Streams, args []string) error {
     var dir string
-    if len(args) < 2 {
-        var err error
-        dir, err = os.UserHomeDir()
-        if err != nil {
-            return err
+    switch {
+    case len(args) < 2:
+        home, ok := s.lookupVar("HOME")
+        if !ok {
+            var err error
+            if home, err = os.UserHomeDir(); err != nil {
+                return err
+            }
         }
-    } else {
+        dir = home
+    case args[1] == "-":
+        old, ok := s.lookupVar("OLDPWD")
+        if !ok {
+            return fmt.Errorf("cd: OLDPWD not set")
+        }
+        dir = old
+        fmt.Fprintln(st.Stdout, dir)
+    default:
         dir = args[1]
     }
 
-    if err := os.Chdir(dir); err != nil {
-        return err
-    }
-
-    newDir, err := os.Getwd()
+    newDir := filepath.Clean(s.resolvePath(dir))
+    info, err := os.Stat(newDir)
     if err != nil {
         return err
     }
+    if !info.IsDir() {
+        return fmt.Errorf("cd: %s: not a directory", dir)
+    }
+
+    s.setVar("OLDPWD", s.workDir)
+    s.setVar("PWD", newDir)
     s.workDir = newDir
     return nil
 }
 
-func exitCommand(s *Shell, args []string) error {
-    s.Stop()
-    os.Exit(0)
-    return nil
+func exitCommand(s *Shell, st Streams, args []string) error {
+    status := s.lastExitCode
+    if len(args) > 1 {
+        n, err := strconv.Atoi(args[1])
+        if err != nil {
+            return fmt.Errorf("exit: %s: numeric argument required", args[1])
+        }
+        status = n & 0xff
+    }
+    return &exitControl{Status: status}
 }
 
-func aliasCommand(s *Shell, args []string) error {
+func aliasCommand(s *Shell, st Streams, args []string) error {
 	if len(args) == 1 {
 			aliases := s.aliases.GetAll()
 			var sortedAliases []string
@@ -90,7 +221,7 @@ func aliasCommand(s *Shell, args []string) error {
 			}
 			sort.Strings(sortedAliases)
 			for _, alias := range sortedAliases {
-					fmt.Println(alias)
+					fmt.Fprintln(st.Stdout, alias)
 			}
 			return nil
 	}
@@ -108,7 +239,7 @@ func aliasCommand(s *Shell, args []string) error {
 }
 
 
-func historyCommand(s *Shell, args []string) error {
+func historyCommand(s *Shell, st Streams, args []string) error {
 		entries := s.history.GetAll()
 		if len(args) > 1 {
 				count := 0
@@ -120,22 +251,22 @@ func historyCommand(s *Shell, args []string) error {
 		}
 			
 		for i, entry := range entries {
-				fmt.Printf("%5d  %s\n", i+1, entry)
+				fmt.Fprintf(st.Stdout, "%5d  %s\n", i+1, entry)
 		}
 				return nil
 }
 	
-func helpCommand(s *Shell, args []string) error {
+func helpCommand(s *Shell, st Streams, args []string) error {
 		if len(args) > 1 {
 				if cmd, exists := builtinCommands[args[1]]; exists {
-						fmt.Printf("%s - %s\n", cmd.Name, cmd.Description)
+						fmt.Fprintf(st.Stdout, "%s - %s\n", cmd.Name, cmd.Description)
 						return nil
 				}
 				
 				return fmt.Errorf("no help available for '%s'", args[1])
 			}
 	
-		fmt.Println("Built-in commands:")
+		fmt.Fprintln(st.Stdout, "Built-in commands:")
 		var names []string
 		for name := range builtinCommands {
 				names = append(names, name)
@@ -144,52 +275,955 @@ func helpCommand(s *Shell, args []string) error {
 		sort.Strings(names)
 			
 		for _, name := range names {
-				fmt.Printf("  %-10s - %s\n", name, builtinCommands[name].Description)
+				fmt.Fprintf(st.Stdout, "  %-10s - %s\n", name, builtinCommands[name].Description)
 		}
 
 		return nil
 }
 	
-	func exportCommand(s *Shell, args []string) error {
-			if len(args) < 2 {
-					for _, env := range os.Environ() {
-							fmt.Println(env)
-					}
-					return nil
-			}
-	
-			for _, arg := range args[1:] {
-					parts := strings.SplitN(arg, "=", 2)
-					if len(parts) != 2 {
-							return fmt.Errorf("invalid export format: %s", arg)
-					}
-					if err := os.Setenv(parts[0], parts[1]); err != nil {
-							return err
-					}
-			}
-			return nil
-	}
-	
-	func sourceCommand(s *Shell, args []string) error {
+	func sourceCommand(s *Shell, st Streams, args []string) error {
 			if len(args) < 2 {
 					return fmt.Errorf("source: filename argument required")
 			}
 	
 			filename := args[1]
-			content, err := os.ReadFile(filename)
+			content, err := os.ReadFile(s.resolvePath(filename))
 			if err != nil {
 					return err
 			}
-	
-			commands := strings.Split(string(content), "\n")
-			for _, cmd := range commands {
-					cmd = strings.TrimSpace(cmd)
-					if cmd == "" || strings.HasPrefix(cmd, "#") {
-							continue
-					}
-					if err := s.Execute(cmd); err != nil {
-							return fmt.Errorf("source: error executing '%s': %v", cmd, err)
-					}
+
+			if len(args) > 2 {
+					params := s.params
+					s.params = args[2:]
+					defer func() { s.params = params }()
+			}
+
+			s.callDepth++
+			err = s.run(string(content))
+			s.callDepth--
+
+			var ret *returnControl
+			if errors.As(err, &ret) {
+					s.lastExitCode = ret.Status
+					return s.status()
+			}
+			if isControlFlow(err) {
+					return err
+			}
+			if err != nil {
+					return fmt.Errorf("source: %s: %w", filename, err)
+			}
+			return s.status()
+	}
+
+// shoptNames lists the options known to shopt. Extended glob patterns are
+// always recognised; extglob is accepted so that scripts enabling it work.
+var shoptNames = []string{"dotglob", "extglob", "failglob", "globstar", "nullglob"}
+
+func shoptCommand(s *Shell, st Streams, args []string) error {
+	set, unset, print := false, false, false
+	names := args[1:]
+
+	for len(names) > 0 && strings.HasPrefix(names[0], "-") {
+		switch names[0] {
+		case "-s":
+			set = true
+		case "-u":
+			unset = true
+		case "-p":
+			print = true
+		default:
+			return fmt.Errorf("shopt: %s: invalid option", names[0])
+		}
+		names = names[1:]
+	}
+
+	if len(names) == 0 {
+		names = shoptNames
+	}
+
+	for _, name := range names {
+		known := false
+		for _, n := range shoptNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("shopt: %s: invalid shell option name", name)
+		}
+	}
+
+	switch {
+	case set || unset:
+		for _, name := range names {
+			s.shopts[name] = set
+		}
+
+	default:
+		for _, name := range names {
+			switch {
+			case print && s.shopts[name]:
+				fmt.Fprintf(st.Stdout, "shopt -s %s\n", name)
+			case print:
+				fmt.Fprintf(st.Stdout, "shopt -u %s\n", name)
+			case s.shopts[name]:
+				fmt.Fprintf(st.Stdout, "%-15s\ton\n", name)
+			default:
+				fmt.Fprintf(st.Stdout, "%-15s\toff\n", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// breakCommand implements both break and continue. The optional argument
+// is the number of enclosing loops to unwind; it is capped at the current
+// nesting depth.
+func breakCommand(s *Shell, st Streams, args []string) error {
+	levels := 1
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("%s: %s: loop count out of range", args[0], args[1])
+		}
+		levels = n
+	}
+
+	if s.loopDepth == 0 {
+		return fmt.Errorf("%s: only meaningful in a for, while, or until loop", args[0])
+	}
+
+	return &loopControl{Continue: args[0] == "continue", Levels: min(levels, s.loopDepth)}
+}
+
+func returnCommand(s *Shell, st Streams, args []string) error {
+	if s.callDepth == 0 {
+		return fmt.Errorf("return: can only return from a function or sourced script")
+	}
+
+	status := s.lastExitCode
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("return: %s: numeric argument required", args[1])
+		}
+		status = n & 0xff
+	}
+
+	return &returnControl{Status: status}
+}
+
+// functionsCommand prints the definitions of the named functions, or of
+// all functions in name order.
+func functionsCommand(s *Shell, st Streams, args []string) error {
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range s.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		fn, ok := s.functions[name]
+		if !ok {
+			return fmt.Errorf("%s: %s: not found", args[0], name)
+		}
+		fmt.Fprintln(st.Stdout, fn.Source)
+	}
+	return nil
+}
+
+// declareOptions are the attributes and modes accepted by declare, local,
+// export and readonly.
+type declareOptions struct {
+	export    bool
+	unexport  bool
+	readonly  bool
+	array     bool
+	assoc     bool
+	print     bool
+	functions bool
+	funcNames bool
+	local     bool
+}
+
+// parseDeclareOptions parses leading options made of the letters in valid.
+// A '+' in place of '-' removes an attribute; only +x is meaningful.
+func parseDeclareOptions(cmd, valid string, args []string) (declareOptions, []string, error) {
+	var opts declareOptions
+
+	for len(args) > 0 && len(args[0]) > 1 && (args[0][0] == '-' || args[0][0] == '+') {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+
+		remove := args[0][0] == '+'
+		for _, c := range args[0][1:] {
+			if !strings.ContainsRune(valid, c) {
+				return opts, nil, fmt.Errorf("%s: %c%c: invalid option", cmd, args[0][0], c)
+			}
+			switch c {
+			case 'x':
+				opts.export, opts.unexport = !remove, remove
+			case 'n':
+				opts.unexport = true
+			case 'r':
+				opts.readonly = true
+			case 'a':
+				opts.array = true
+			case 'A':
+				opts.assoc = true
+			case 'p':
+				opts.print = true
+			case 'f':
+				opts.functions = true
+			case 'F':
+				opts.funcNames = true
+			}
+		}
+		args = args[1:]
+	}
+
+	return opts, args, nil
+}
+
+// declareVars applies opts to each NAME[=value] in args. The value may be
+// an array assignment, "(...)", which is parsed and expanded here, or the
+// name may have a subscript or be followed by += to append.
+func (s *Shell) declareVars(cmd string, opts declareOptions, args []string) error {
+	for _, arg := range args {
+		target, value, hasValue := strings.Cut(arg, "=")
+		appendTo := hasValue && strings.HasSuffix(target, "+")
+		if appendTo {
+			target = target[:len(target)-1]
+		}
+
+		name := paramName(target)
+		if !isName(name) || paramRef(target) != len(target) {
+			return fmt.Errorf("%s: '%s': not a valid identifier", cmd, arg)
+		}
+
+		if opts.local {
+			if err := s.makeLocal(name); err != nil {
+				return fmt.Errorf("%s: %w", cmd, err)
+			}
+		}
+		if opts.array || opts.assoc {
+			if err := s.declareArray(name, opts.assoc); err != nil {
+				return fmt.Errorf("%s: %w", cmd, err)
+			}
+		}
+
+		var err error
+		switch {
+		case !hasValue:
+		case len(target) > len(name):
+			err = s.setElem(name, target[len(name)+1:len(target)-1], value, appendTo)
+		case strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")"):
+			var elems []*ArrayElem
+			if elems, err = s.parser.parseArray(value); err == nil {
+				err = s.setArray(name, elems, appendTo)
+			}
+		default:
+			if appendTo {
+				old, _ := s.lookupVar(name)
+				value = old + value
+			}
+			err = s.setVar(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+
+		switch {
+		case opts.export:
+			s.exportVar(name, true)
+		case opts.unexport:
+			if _, ok := s.vars[name]; ok {
+				s.exportVar(name, false)
+			}
+		}
+		if opts.readonly {
+			if _, ok := s.vars[name]; !ok {
+				s.vars[name] = &Variable{Unset: true}
+			}
+			s.vars[name].ReadOnly = true
+		}
+	}
+
+	return nil
+}
+
+// makeLocal shadows name in the running function. The first declaration
+// saves the outer variable, which callFunction restores; the local starts
+// out unset.
+func (s *Shell) makeLocal(name string) error {
+	scope := s.locals[len(s.locals)-1]
+	if _, ok := scope[name]; ok {
+		return nil
+	}
+
+	old := s.vars[name]
+	if old != nil && old.ReadOnly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	scope[name] = old
+	delete(s.vars, name)
+	return nil
+}
+
+// printDeclarations prints the named variables, or every variable for
+// which keep is true, as declare -p does.
+func (s *Shell) printDeclarations(w io.Writer, cmd string, names []string, keep func(*Variable) bool) error {
+	if len(names) == 0 {
+		names = s.varNames(keep)
+	}
+	for _, name := range names {
+		name, _, _ = strings.Cut(name, "=")
+		if _, ok := s.vars[name]; !ok {
+			return fmt.Errorf("%s: %s: not found", cmd, name)
+		}
+		fmt.Fprintln(w, s.declaration(name))
+	}
+	return nil
+}
+
+// declareCommand sets variables and their attributes. Inside a function
+// the variables are local, as with local. With -f or -F it lists functions.
+func declareCommand(s *Shell, st Streams, args []string) error {
+	opts, names, err := parseDeclareOptions("declare", "aAfFprx", args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.functions:
+		return functionsCommand(s, st, append([]string{"declare"}, names...))
+
+	case opts.funcNames:
+		if len(names) == 0 {
+			for name := range s.functions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			if _, ok := s.functions[name]; !ok {
+				return fmt.Errorf("declare: %s: not found", name)
+			}
+			fmt.Fprintf(st.Stdout, "declare -f %s\n", name)
+		}
+		return nil
+
+	case opts.print || len(names) == 0:
+		return s.printDeclarations(st.Stdout, "declare", names, func(v *Variable) bool {
+			return (!opts.export || v.Exported) && (!opts.readonly || v.ReadOnly) &&
+				(!opts.array || v.Array != nil) && (!opts.assoc || v.Assoc != nil)
+		})
+	}
+
+	opts.local = len(s.locals) > 0
+	return s.declareVars("declare", opts, names)
+}
+
+func localCommand(s *Shell, st Streams, args []string) error {
+	if len(s.locals) == 0 {
+		return fmt.Errorf("local: can only be used in a function")
+	}
+
+	opts, names, err := parseDeclareOptions("local", "aArx", args[1:])
+	if err != nil {
+		return err
+	}
+	opts.local = true
+	return s.declareVars("local", opts, names)
+}
+
+func exportCommand(s *Shell, st Streams, args []string) error {
+	opts, names, err := parseDeclareOptions("export", "np", args[1:])
+	if err != nil {
+		return err
+	}
+
+	if opts.print || len(names) == 0 {
+		return s.printDeclarations(st.Stdout, "export", nil, func(v *Variable) bool { return v.Exported })
+	}
+
+	opts.export = !opts.unexport
+	return s.declareVars("export", opts, names)
+}
+
+func readonlyCommand(s *Shell, st Streams, args []string) error {
+	opts, names, err := parseDeclareOptions("readonly", "p", args[1:])
+	if err != nil {
+		return err
+	}
+
+	if opts.print || len(names) == 0 {
+		return s.printDeclarations(st.Stdout, "readonly", nil, func(v *Variable) bool { return v.ReadOnly })
+	}
+
+	opts.readonly = true
+	return s.declareVars("readonly", opts, names)
+}
+
+// unsetCommand removes variables, or functions with -f. Without an option
+// a name that is not a variable removes the function of that name. A name
+// with a subscript, name[index], removes only that element of an array.
+func unsetCommand(s *Shell, st Streams, args []string) error {
+	names := args[1:]
+	vars, funcs := true, true
+
+	for len(names) > 0 && strings.HasPrefix(names[0], "-") {
+		switch names[0] {
+		case "-v":
+			funcs = false
+		case "-f":
+			vars = false
+		default:
+			return fmt.Errorf("unset: %s: invalid option", names[0])
+		}
+		names = names[1:]
+	}
+
+	for _, name := range names {
+		if n := len(paramName(name)); vars && n < len(name) && paramRef(name) == len(name) {
+			if err := s.unsetElem(name[:n], name[n+1:len(name)-1]); err != nil {
+				return fmt.Errorf("unset: %w", err)
+			}
+			continue
+		}
+
+		if _, ok := s.vars[name]; vars && (ok || !funcs) {
+			if err := s.unsetVar(name); err != nil {
+				return fmt.Errorf("unset: %w", err)
+			}
+			continue
+		}
+		if funcs {
+			delete(s.functions, name)
+		}
+	}
+
+	return nil
+}
+
+// readCommand reads a line from standard input and splits it on IFS into
+// the variables named, the last of which gets the rest of the line, or
+// with -a into the elements of an array. Without names the line is stored
+// in REPLY. Unless -r is given a backslash escapes the next character and
+// a backslash-newline continues the line.
+func readCommand(s *Shell, st Streams, args []string) error {
+	var raw bool
+	var array, prompt string
+	names := args[1:]
+
+	for len(names) > 0 && strings.HasPrefix(names[0], "-") && names[0] != "-" {
+		opt := names[0]
+		names = names[1:]
+
+		switch opt {
+		case "--":
+		case "-r":
+			raw = true
+			continue
+		case "-a", "-p":
+			if len(names) == 0 {
+				return fmt.Errorf("read: %s: option requires an argument", opt)
+			}
+			if opt == "-a" {
+				array = names[0]
+			} else {
+				prompt = names[0]
+			}
+			names = names[1:]
+			continue
+		default:
+			return fmt.Errorf("read: %s: invalid option", opt)
+		}
+		break
+	}
+
+	for _, name := range append([]string{array}, names...) {
+		if name != "" && !isName(name) {
+			return fmt.Errorf("read: '%s': not a valid identifier", name)
+		}
+	}
+
+	if prompt != "" {
+		fmt.Fprint(st.Stderr, prompt)
+	}
+	line, eof := readLine(st.Stdin, raw)
+	if eof && line == "" {
+		return exitStatus(1)
+	}
+
+	var err error
+	switch {
+	case array != "":
+		err = s.readArray(array, line)
+	case len(names) == 0:
+		err = s.setVar("REPLY", line)
+	default:
+		fields := splitRead(line, s.ifs(), len(names))
+		for i, name := range names {
+			value := ""
+			if i < len(fields) {
+				value = fields[i]
+			}
+			if err = s.setVar(name, value); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	if eof {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// readLine reads up to a newline from r a byte at a time, so that nothing
+// after the line is consumed. It reports whether input ended first.
+func readLine(r io.Reader, raw bool) (string, bool) {
+	var line strings.Builder
+	var buf [1]byte
+	escaped := false
+
+	for {
+		if n, err := r.Read(buf[:]); n == 0 || err != nil {
+			return line.String(), true
+		}
+		c := buf[0]
+
+		switch {
+		case escaped:
+			escaped = false
+			if c != '\n' {
+				line.WriteByte(c)
+			}
+		case c == '\\' && !raw:
+			escaped = true
+		case c == '\n':
+			return line.String(), false
+		default:
+			line.WriteByte(c)
+		}
+	}
+}
+
+// readArray replaces the elements of the indexed array name with the
+// fields of line.
+func (s *Shell) readArray(name, line string) error {
+	x := &expansion{}
+	x.writeSplit(line, s.ifs())
+	x.endField()
+
+	v, err := s.arrayVar(name)
+	if err != nil {
+		return err
+	}
+	if v.Assoc != nil {
+		return fmt.Errorf("%s: cannot convert associative to indexed array", name)
+	}
+
+	v.Array = make(map[int]string, len(x.fields))
+	for i, field := range x.fields {
+		v.Array[i] = field
+	}
+	return nil
+}
+
+// splitRead splits line into at most n fields on the characters of ifs.
+// The last field is the rest of the line, less trailing IFS whitespace.
+func splitRead(line, ifs string, n int) []string {
+	isSpace := func(c byte) bool {
+		return strings.IndexByte(ifs, c) >= 0 && strings.IndexByte(defaultIFS, c) >= 0
+	}
+	trimSpace := func(s string) string {
+		for len(s) > 0 && isSpace(s[0]) {
+			s = s[1:]
+		}
+		return s
+	}
+
+	var fields []string
+	line = trimSpace(line)
+
+	for len(fields) < n-1 && line != "" {
+		i := strings.IndexAny(line, ifs)
+		if i < 0 {
+			fields = append(fields, line)
+			return fields
+		}
+		fields = append(fields, line[:i])
+
+		// A separator is IFS whitespace around at most one other IFS
+		// character.
+		line = trimSpace(line[i:])
+		if line != "" && !isSpace(line[0]) && strings.IndexByte(ifs, line[0]) >= 0 {
+			line = trimSpace(line[1:])
+		}
+	}
+
+	for len(line) > 0 && isSpace(line[len(line)-1]) {
+		line = line[:len(line)-1]
+	}
+	if line != "" || len(fields) < n {
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// letCommand evaluates each argument as an arithmetic expression. It fails
+// when the last one evaluates to 0.
+func letCommand(s *Shell, st Streams, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("let: expression expected")
+	}
+
+	var n int64
+	for _, expr := range args[1:] {
+		var err error
+		if n, err = s.arith(expr); err != nil {
+			return fmt.Errorf("let: %w", err)
+		}
+	}
+
+	if n == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// setoptNames lists the options known to set -o.
+var setoptNames = []string{"pipefail"}
+
+// setCommand implements set. "-o name" and "+o name" turn an option on and
+// off, and on their own list the options. The remaining arguments, or all
+// those after "--", replace the positional parameters. Without arguments
+// it prints the shell variables.
+func setCommand(s *Shell, st Streams, args []string) error {
+	if len(args) == 1 {
+		for _, name := range s.varNames(func(*Variable) bool { return true }) {
+			_, assignment, _ := strings.Cut(strings.TrimPrefix(s.declaration(name), "declare "), " ")
+			fmt.Fprintln(st.Stdout, assignment)
+		}
+		return nil
+	}
+
+	args = args[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			s.params = args[1:]
+			return nil
+		}
+		if arg != "-o" && arg != "+o" {
+			break
+		}
+		on := arg == "-o"
+		args = args[1:]
+
+		if len(args) == 0 {
+			printSetopts(s, st.Stdout, on)
+			return nil
+		}
+		known := false
+		for _, n := range setoptNames {
+			known = known || n == args[0]
+		}
+		if !known {
+			return fmt.Errorf("set: %s: invalid option name", args[0])
+		}
+		s.setopts[args[0]] = on
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		if strings.HasPrefix(args[0], "-") || strings.HasPrefix(args[0], "+") {
+			return fmt.Errorf("set: %s: invalid option", args[0])
+		}
+		s.params = args
+	}
+	return nil
+}
+
+// printSetopts lists the set -o options, as a table for "set -o" and as
+// commands that restore them for "set +o".
+func printSetopts(s *Shell, w io.Writer, table bool) {
+	for _, name := range setoptNames {
+		switch {
+		case table && s.setopts[name]:
+			fmt.Fprintf(w, "%-15s\ton\n", name)
+		case table:
+			fmt.Fprintf(w, "%-15s\toff\n", name)
+		case s.setopts[name]:
+			fmt.Fprintf(w, "set -o %s\n", name)
+		default:
+			fmt.Fprintf(w, "set +o %s\n", name)
+		}
+	}
+}
+
+// jobFlags splits the single-letter options in valid off the front of args.
+func jobFlags(cmd, valid string, args []string) (map[byte]bool, []string, error) {
+	flags := make(map[byte]bool)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "--" {
+			return flags, args[1:], nil
+		}
+		for i := 1; i < len(args[0]); i++ {
+			if strings.IndexByte(valid, args[0][i]) < 0 {
+				return nil, nil, fmt.Errorf("%s: -%c: invalid option", cmd, args[0][i])
+			}
+			flags[args[0][i]] = true
+		}
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+// lookupJobs resolves job specs, or returns the current job if there are
+// none.
+func lookupJobs(s *Shell, cmd string, specs []string) ([]int, error) {
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+
+	var ids []int
+	for _, spec := range specs {
+		id, err := s.jobs.Lookup(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cmd, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// jobsCommand lists jobs, with -l their process IDs too and with -p only
+// those. -r and -s restrict the list to running and stopped jobs. Finished
+// jobs are removed once listed.
+func jobsCommand(s *Shell, st Streams, args []string) error {
+	flags, specs, err := jobFlags("jobs", "lprs", args[1:])
+	if err != nil {
+		return err
+	}
+
+	jobs := s.jobs.List()
+	if len(specs) > 0 {
+		ids, err := lookupJobs(s, "jobs", specs)
+		if err != nil {
+			return err
+		}
+		jobs = jobs[:0]
+		for _, id := range ids {
+			if j, ok := s.jobs.Get(id); ok {
+				jobs = append(jobs, j)
+			}
+		}
+	}
+
+	for _, j := range jobs {
+		if (flags['r'] && j.Status != job.StatusRunning) || (flags['s'] && j.Status != job.StatusStopped) {
+			continue
+		}
+
+		switch {
+		case flags['p']:
+			pid := j.ProcessGroup
+			if pid == 0 {
+				pid = j.Pid
 			}
+			fmt.Fprintln(st.Stdout, pid)
+		default:
+			fmt.Fprintln(st.Stdout, s.jobLine(j, flags['l']))
+		}
+
+		if j.Status == job.StatusDone {
+			s.jobs.Remove(j.Id)
+		}
+	}
+	return nil
+}
+
+// fgCommand continues a job, the current one by default, in the
+// foreground and waits for it to finish or stop again.
+func fgCommand(s *Shell, st Streams, args []string) error {
+	ids, err := lookupJobs(s, "fg", args[1:min(len(args), 2)])
+	if err != nil {
+		return err
+	}
+	j, _ := s.jobs.Get(ids[0])
+	fmt.Fprintln(st.Stdout, j.Command)
+
+	if j.Status != job.StatusDone {
+		// The shell takes the terminal back once the job stops or exits.
+		tty, foreground := s.terminal()
+		if foreground {
+			if j.ProcessGroup != 0 {
+				tcsetpgrp(tty, j.ProcessGroup)
+			}
+			defer s.reclaimTerminal(tty)
+		}
+
+		s.continueJob(j, false)
+		var ok bool
+		if j, ok = s.jobs.WaitStatus(j.Id, job.StatusStopped, job.StatusDone); !ok {
 			return nil
-	}	
+		}
+	}
+
+	if j.Status == job.StatusStopped {
+		fmt.Fprintf(st.Stderr, "\n%s\n", s.jobLine(j, false))
+		return exitStatus(128 + int(syscall.SIGTSTP))
+	}
+
+	s.jobs.Remove(j.Id)
+	s.lastExitCode = j.ExitCode
+	return s.status()
+}
+
+// bgCommand continues stopped jobs, the current one by default, in the
+// background.
+func bgCommand(s *Shell, st Streams, args []string) error {
+	ids, err := lookupJobs(s, "bg", args[1:])
+	if err != nil {
+		return err
+	}
+
+	var status error
+	for _, id := range ids {
+		j, _ := s.jobs.Get(id)
+		switch j.Status {
+		case job.StatusDone:
+			fmt.Fprintf(st.Stderr, "bg: job %d has terminated\n", id)
+			status = exitStatus(1)
+			continue
+		case job.StatusRunning:
+			fmt.Fprintf(st.Stderr, "bg: job %d already in background\n", id)
+			continue
+		}
+		s.continueJob(j, true)
+		fmt.Fprintf(st.Stdout, "[%d]%c %s &\n", id, s.jobs.Mark(id), j.Command)
+	}
+	return status
+}
+
+// disownCommand removes jobs, the current one by default, from the job
+// table, or with -h only keeps them from being sent SIGHUP. -a applies to
+// every job and -r to every running one.
+func disownCommand(s *Shell, st Streams, args []string) error {
+	flags, specs, err := jobFlags("disown", "ahr", args[1:])
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	if flags['a'] || flags['r'] {
+		for _, j := range s.jobs.List() {
+			if !flags['r'] || j.Status == job.StatusRunning {
+				ids = append(ids, j.Id)
+			}
+		}
+	} else if ids, err = lookupJobs(s, "disown", specs); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if flags['h'] {
+			s.jobs.SetNoHup(id)
+		} else {
+			s.jobs.Remove(id)
+		}
+	}
+	return nil
+}
+
+// waitCommand waits for jobs, given by job spec or process ID, to finish
+// and returns the status of the last one. Without arguments it waits for
+// every job and succeeds; with -n it waits for whichever job finishes
+// first. Jobs waited for are removed from the job table.
+func waitCommand(s *Shell, st Streams, args []string) error {
+	flags, specs, err := jobFlags("wait", "n", args[1:])
+	if err != nil {
+		return err
+	}
+
+	status := 0
+	var ids []int
+	for _, spec := range specs {
+		if strings.HasPrefix(spec, "%") {
+			id, err := s.jobs.Lookup(spec)
+			if err != nil {
+				fmt.Fprintf(st.Stderr, "wait: %v\n", err)
+				status = 127
+				continue
+			}
+			ids = append(ids, id)
+			continue
+		}
+
+		pid, err := strconv.Atoi(spec)
+		if err != nil {
+			return fmt.Errorf("wait: %s: not a pid or valid job spec", spec)
+		}
+		id := 0
+		for _, j := range s.jobs.List() {
+			if j.Pid == pid || j.ProcessGroup == pid {
+				id = j.Id
+			}
+		}
+		if id == 0 {
+			fmt.Fprintf(st.Stderr, "wait: pid %d is not a child of this shell\n", pid)
+			status = 127
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	all := len(specs) == 0
+	if all {
+		for _, j := range s.jobs.List() {
+			ids = append(ids, j.Id)
+		}
+	}
+
+	finished := func(j job.Job) int {
+		if j.Status == job.StatusStopped {
+			return 128 + int(syscall.SIGTSTP)
+		}
+		s.jobs.Remove(j.Id)
+		return j.ExitCode
+	}
+
+	switch {
+	case flags['n']:
+		j, ok := s.jobs.WaitAny(ids)
+		if !ok {
+			return exitStatus(127)
+		}
+		status = finished(j)
+
+	default:
+		for _, id := range ids {
+			if j, ok := s.jobs.WaitStatus(id, job.StatusStopped, job.StatusDone); ok {
+				status = finished(j)
+			}
+		}
+		if all {
+			status = 0
+		}
+	}
+
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
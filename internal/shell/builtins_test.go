@@ -0,0 +1,55 @@
+package shell
+
+import (
+	"testing"
+
+	"gosh/internal/job"
+)
+
+func TestJobBuiltins(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "wait status", script: "sh -c 'exit 3' & wait %1", want: "", status: 3},
+		{name: "bg on running job", script: "sleep 5 & bg %1; kill $!; wait", want: "bg: job 1 already in background\n"},
+		{name: "no such job", script: "fg %3", want: "Error: fg: %3: no such job\n", status: 1},
+		{name: "jobs in pipeline", script: "sleep 5 & jobs | cat; kill $!; wait", want: "[1]+  Running                 sleep 5 &\n"},
+	})
+}
+
+// TestJobBuiltinsOnFinishedJobs starts a job and waits in the job table for
+// it to finish, without reaping it, before running the builtin on it.
+func TestJobBuiltinsOnFinishedJobs(t *testing.T) {
+	tests := []struct {
+		name   string
+		job    string
+		script string
+		want   string
+		status int
+	}{
+		{"bg", "true &", "bg %1", "bg: job 1 has terminated\n", 1},
+		{"fg", "sh -c 'exit 2' &", "fg %1", "sh -c 'exit 2'\n", 2},
+		{"jobs", "true &", "jobs", "[1]+  Done                    true\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestShell(t)
+			if _, _, err := runScript(t, s, tt.job); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := s.jobs.WaitStatus(1, job.StatusDone); !ok {
+				t.Fatal("job 1 is not in the job table")
+			}
+
+			got, status, err := runScript(t, s, tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
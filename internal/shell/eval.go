@@ -0,0 +1,826 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"gosh/internal/job"
+)
+
+// runList runs every item of list. It stops early only when a builtin such
+// as break unwinds the evaluator, and returns that control flow error.
+func (s *Shell) runList(ctx context.Context, list *List) error {
+	for _, item := range list.Items {
+		if item.Background {
+			s.setStatus(s.runBackground(ctx, item))
+			continue
+		}
+		if err := s.runAndOr(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBackground starts item as a job and returns without waiting for it.
+// A single pipeline runs as it would in the foreground; anything else runs
+// as the internal stage of a pipeline of its own, in a subshell whose
+// commands join the process group of the pipeline's leader. The process
+// substitutions expanded for the job are finished once it is.
+func (s *Shell) runBackground(ctx context.Context, item *AndOr) error {
+	mark := len(s.executor.procSubsts)
+
+	var commands []Command
+	if len(item.Pipelines) == 1 && !item.Pipelines[0].Negated {
+		var err error
+		if commands, err = s.stages(ctx, item.Pipelines[0]); err != nil {
+			s.executor.finishProcSubsts(mark)
+			return err
+		}
+	} else {
+		commands = []Command{{Internal: func(sub *Shell) error {
+			if err := sub.runAndOr(ctx, item); err != nil {
+				return err
+			}
+			return sub.status()
+		}}}
+	}
+
+	pg, err := s.executor.Background(ctx, commands)
+	if err != nil {
+		s.executor.finishProcSubsts(mark)
+		return err
+	}
+	pg.procSubsts = s.executor.takeProcSubsts(mark)
+
+	pid := pg.lastPid()
+	id := s.jobs.Add(item.Source, pid, pg.Pgid, true)
+	s.lastBgPid = pid
+	if s.interactive {
+		fmt.Fprintf(s.stderr, "[%d] %d\n", id, pid)
+	}
+
+	go s.monitorJob(id, pg)
+	return nil
+}
+
+// stopJob adds a foreground pipeline that was stopped to the job table, and
+// returns the status of a command stopped by SIGTSTP.
+func (s *Shell) stopJob(command string, pg *ProcessGroup) error {
+	id := s.jobs.Add(command, pg.lastPid(), pg.Pgid, false)
+	s.jobs.UpdateStatus(id, job.StatusStopped)
+
+	j, _ := s.jobs.Get(id)
+	fmt.Fprintf(s.stderr, "\n%s\n", s.jobLine(j, false))
+
+	go s.monitorJob(id, pg)
+	return exitStatus(128 + int(syscall.SIGTSTP))
+}
+
+// monitorJob waits for the pipeline of a job until it finishes, recording
+// when it stops and waiting again once fg or bg has continued it, and then
+// finishes its process substitutions. A job that was disowned is still
+// reaped.
+func (s *Shell) monitorJob(id int, pg *ProcessGroup) {
+	for {
+		s.jobs.WaitStatus(id, job.StatusRunning)
+
+		err := s.executor.wait(pg)
+		if _, stopped := err.(*stoppedError); !stopped {
+			s.jobs.Finish(id, exitCode(err))
+			for _, ps := range pg.procSubsts {
+				ps.finish()
+			}
+			return
+		}
+		s.jobs.UpdateStatus(id, job.StatusStopped)
+	}
+}
+
+// continueJob makes a stopped job run again, in the background or, with
+// the terminal handed to it, in the foreground.
+func (s *Shell) continueJob(j job.Job, background bool) {
+	s.jobs.SetBackground(j.Id, background)
+	s.jobs.UpdateStatus(j.Id, job.StatusRunning)
+	if j.ProcessGroup != 0 {
+		syscall.Kill(-j.ProcessGroup, syscall.SIGCONT)
+	}
+}
+
+// jobLine formats a job the way jobs lists it, with its process ID when
+// long is set.
+func (s *Shell) jobLine(j job.Job, long bool) string {
+	state := "Running"
+	switch {
+	case j.Status == job.StatusStopped:
+		state = "Stopped"
+	case j.Status == job.StatusDone && j.ExitCode != 0:
+		state = fmt.Sprintf("Exit %d", j.ExitCode)
+	case j.Status == job.StatusDone:
+		state = "Done"
+	}
+
+	command := j.Command
+	if j.Status == job.StatusRunning && j.Background {
+		command += " &"
+	}
+
+	if long {
+		return fmt.Sprintf("[%d]%c %d %-24s%s", j.Id, s.jobs.Mark(j.Id), j.Pid, state, command)
+	}
+	return fmt.Sprintf("[%d]%c  %-24s%s", j.Id, s.jobs.Mark(j.Id), state, command)
+}
+
+// notifyJobs reports the jobs that have finished since it last ran and
+// removes them from the job table.
+func (s *Shell) notifyJobs() {
+	for _, j := range s.jobs.Done() {
+		fmt.Fprintln(s.stderr, s.jobLine(j, false))
+		s.jobs.Remove(j.Id)
+	}
+}
+
+// hangupJobs sends SIGHUP to the jobs not marked with disown -h, continuing
+// the stopped ones so that they receive it.
+func (s *Shell) hangupJobs() {
+	for _, j := range s.jobs.List() {
+		if j.NoHup || j.ProcessGroup == 0 || j.Status == job.StatusDone {
+			continue
+		}
+		syscall.Kill(-j.ProcessGroup, syscall.SIGHUP)
+		if j.Status == job.StatusStopped {
+			syscall.Kill(-j.ProcessGroup, syscall.SIGCONT)
+		}
+	}
+}
+
+// runAndOr evaluates the chain left to right, skipping a pipeline after &&
+// when the previous status is non-zero and after || when it is zero.
+func (s *Shell) runAndOr(ctx context.Context, andOr *AndOr) error {
+	for i, pipeline := range andOr.Pipelines {
+		if err := s.executor.killed(); err != nil {
+			return err
+		}
+		if i > 0 {
+			op := andOr.Ops[i-1]
+			if (op == TokenAnd && s.lastExitCode != 0) || (op == TokenOr && s.lastExitCode == 0) {
+				continue
+			}
+		}
+
+		mark := len(s.executor.procSubsts)
+		err := s.runPipeline(ctx, pipeline)
+
+		var stopped *stoppedError
+		if errors.As(err, &stopped) {
+			stopped.pg.procSubsts = s.executor.takeProcSubsts(mark)
+			err = s.stopJob(andOr.Source, stopped.pg)
+		}
+		s.executor.finishProcSubsts(mark)
+		if isControlFlow(err) {
+			return err
+		}
+		s.setStatus(err)
+
+		// The executor records the status of every stage of a pipeline,
+		// and a compound command leaves that of the last pipeline it ran,
+		// unless that ran in a subshell.
+		if len(pipeline.Commands) == 1 {
+			switch pipeline.Commands[0].(type) {
+			case *Command, *Subshell:
+				s.setPipeStatus([]int{s.lastExitCode})
+			}
+		}
+
+		if pipeline.Negated {
+			s.lastExitCode = boolStatus(s.lastExitCode != 0)
+		}
+	}
+	return nil
+}
+
+// controlFlow is implemented by errors that unwind the evaluator instead of
+// reporting a failure.
+type controlFlow interface {
+	error
+	controlFlow()
+}
+
+func isControlFlow(err error) bool {
+	var cf controlFlow
+	return errors.As(err, &cf)
+}
+
+// loopControl is returned by break and continue to leave or restart the
+// Levels-th enclosing loop.
+type loopControl struct {
+	Continue bool
+	Levels   int
+}
+
+func (l *loopControl) Error() string {
+	if l.Continue {
+		return "continue outside a loop"
+	}
+	return "break outside a loop"
+}
+
+func (*loopControl) controlFlow() {}
+
+// returnControl is returned by return to leave the current function or
+// sourced file with Status.
+type returnControl struct {
+	Status int
+}
+
+func (r *returnControl) Error() string {
+	return "return outside a function"
+}
+
+func (*returnControl) controlFlow() {}
+
+// exitControl is returned by exit. It ends the shell, or only the subshell
+// it was run in.
+type exitControl struct {
+	Status int
+}
+
+func (e *exitControl) Error() string {
+	return fmt.Sprintf("exit %d", e.Status)
+}
+
+func (*exitControl) controlFlow() {}
+
+// exitStatus is returned by compound commands to pass on the status of the
+// last command they ran, which has already been reported.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// boolStatus returns the exit status for a condition: 0 when ok is true
+// and 1 otherwise.
+func boolStatus(ok bool) int {
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+// status returns lastExitCode as an error for a compound command to return.
+func (s *Shell) status() error {
+	if s.lastExitCode == 0 {
+		return nil
+	}
+	return exitStatus(s.lastExitCode)
+}
+
+// setStatus records the outcome of a pipeline in lastExitCode. Failures are
+// reported here rather than returned so that the rest of the list still runs.
+func (s *Shell) setStatus(err error) {
+	s.lastExitCode = exitCode(err)
+
+	var status exitStatus
+	if err != nil && !errors.As(err, &status) {
+		fmt.Fprintf(s.stderr, "Error: %v\n", err)
+	}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var status exitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		return 1
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return 127
+	}
+
+	return 1
+}
+
+func (s *Shell) runPipeline(ctx context.Context, pipeline *Pipeline) error {
+	if len(pipeline.Commands) == 1 {
+		cmd, ok := pipeline.Commands[0].(*Command)
+		if !ok {
+			return s.runCompound(ctx, pipeline.Commands[0])
+		}
+
+		expanded, assigns, err := s.expandCommand(cmd)
+		if err != nil {
+			return err
+		}
+		if len(expanded.Args) == 0 {
+			return s.runAssignments(cmd.Assigns, cmd.Redirects)
+		}
+		return s.runSimple(ctx, expanded, assigns)
+	}
+
+	commands, err := s.stages(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return s.executor.Execute(ctx, commands)
+}
+
+// stages expands the commands of a pipeline for the Executor. Those that
+// run in the shell become internal stages.
+func (s *Shell) stages(ctx context.Context, pipeline *Pipeline) ([]Command, error) {
+	commands := make([]Command, 0, len(pipeline.Commands))
+
+	for _, node := range pipeline.Commands {
+		cmd, ok := node.(*Command)
+		if !ok {
+			commands = append(commands, Command{Internal: func(sub *Shell) error {
+				return sub.runCompound(ctx, node)
+			}})
+			continue
+		}
+
+		expanded, assigns, err := s.expandCommand(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case len(expanded.Args) == 0:
+			expanded.Internal = func(sub *Shell) error {
+				return sub.runAssignments(cmd.Assigns, cmd.Redirects)
+			}
+		case s.isInternal(expanded.Args[0]):
+			stage := expanded
+			expanded.Internal = func(sub *Shell) error {
+				return sub.runSimple(ctx, stage, assigns)
+			}
+		}
+		commands = append(commands, expanded)
+	}
+
+	return commands, nil
+}
+
+// expandCommand expands the words of a simple command and, if it has a
+// command name, the assignments before it, which it also returns.
+func (s *Shell) expandCommand(cmd *Command) (Command, []string, error) {
+	// Without a command name the status is that of the last command
+	// substitution, if any.
+	if len(cmd.Words) == 0 {
+		s.lastExitCode = 0
+	}
+
+	expanded := *cmd
+	args, err := s.expandArgs(cmd.Words)
+	if err != nil {
+		return expanded, nil, err
+	}
+	expanded.Args = args
+	if len(args) == 0 {
+		return expanded, nil, nil
+	}
+
+	assigns, err := s.expandAssigns(cmd.Assigns)
+	if err != nil {
+		return expanded, nil, err
+	}
+	expanded.Env = s.environ(assigns)
+	return expanded, assigns, nil
+}
+
+// isInternal reports whether name runs in the shell rather than as an
+// external command.
+func (s *Shell) isInternal(name string) bool {
+	_, fn := s.functions[name]
+	_, builtin := builtinCommands[name]
+	return fn || builtin
+}
+
+// runSimple runs an expanded simple command. Functions and builtins run in
+// the shell itself, with their redirections and temporary assignments in
+// effect while they do; anything else is handed to the Executor.
+func (s *Shell) runSimple(ctx context.Context, cmd Command, assigns []string) error {
+	args := cmd.Args
+	s.lastArg = args[len(args)-1]
+
+	if fn, ok := s.functions[args[0]]; ok {
+		return s.withRedirects(cmd.Redirects, func() error {
+			return s.withTempVars(assigns, func() error {
+				return s.callFunction(ctx, fn, args)
+			})
+		})
+	}
+
+	if builtin, ok := builtinCommands[args[0]]; ok {
+		return s.withRedirects(cmd.Redirects, func() error {
+			err := s.withTempVars(assigns, func() error {
+				return builtin.Execute(s, Streams{Stdin: s.stdin, Stdout: s.stdout, Stderr: s.stderr}, args)
+			})
+			if err == nil || isControlFlow(err) {
+				return err
+			}
+			// Report the failure while stderr is still redirected.
+			s.setStatus(err)
+			return s.status()
+		})
+	}
+
+	return s.executor.Execute(ctx, []Command{cmd})
+}
+
+// runAssignments runs a command consisting only of assignments and
+// redirections. The assignments persist in the shell.
+func (s *Shell) runAssignments(assigns []*Assign, redirects []*Redirect) error {
+	for _, a := range assigns {
+		if err := s.assign(a); err != nil {
+			return err
+		}
+	}
+	if err := s.touchRedirects(redirects); err != nil {
+		return err
+	}
+	return s.status()
+}
+
+// touchRedirects performs the redirections of a command without a name,
+// such as "> file", which only creates or truncates the target.
+func (s *Shell) touchRedirects(redirects []*Redirect) error {
+	for _, r := range redirects {
+		if r.Op == TokenRedirectDupIn || r.Op == TokenRedirectDupOut {
+			continue
+		}
+
+		file, err := s.executor.openRedirect(r)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// runCompound runs a compound command in the shell itself.
+func (s *Shell) runCompound(ctx context.Context, node Node) error {
+	switch node := node.(type) {
+	case *List:
+		if err := s.runList(ctx, node); err != nil {
+			return err
+		}
+		return s.status()
+
+	case *IfClause:
+		return s.runIf(ctx, node)
+
+	case *ForClause:
+		return s.runFor(ctx, node)
+
+	case *ArithForClause:
+		return s.runArithFor(ctx, node)
+
+	case *ArithCommand:
+		return s.runArithCommand(node)
+
+	case *WhileClause:
+		return s.runWhile(ctx, node)
+
+	case *CaseClause:
+		return s.runCase(ctx, node)
+
+	case *Block:
+		if err := s.runList(ctx, node.List); err != nil {
+			return err
+		}
+		return s.status()
+
+	case *Subshell:
+		s.lastExitCode = s.subshell().runAsSubshell(ctx, node.List)
+		return s.status()
+
+	case *Redirected:
+		return s.runRedirected(ctx, node)
+
+	case *FuncDecl:
+		s.functions[node.Name] = node
+		return nil
+	}
+
+	return fmt.Errorf("unsupported command node %T", node)
+}
+
+// runIf runs the first branch whose condition succeeds. Its status is that
+// of the branch, or zero if none ran.
+func (s *Shell) runIf(ctx context.Context, clause *IfClause) error {
+	if err := s.runList(ctx, clause.Cond); err != nil {
+		return err
+	}
+
+	switch {
+	case s.lastExitCode == 0:
+		return s.runCompound(ctx, clause.Then)
+	case clause.Else != nil:
+		return s.runCompound(ctx, clause.Else)
+	}
+	return nil
+}
+
+// runLoopBody runs one iteration of a loop body and reports whether the loop
+// should stop. A break or continue aimed at an outer loop is returned with
+// one level fewer.
+func (s *Shell) runLoopBody(ctx context.Context, body *List) (bool, error) {
+	err := s.runList(ctx, body)
+	if err == nil {
+		return false, nil
+	}
+
+	var lc *loopControl
+	if !errors.As(err, &lc) {
+		return true, err
+	}
+	if lc.Levels > 1 {
+		lc.Levels--
+		return true, lc
+	}
+	return !lc.Continue, nil
+}
+
+// runLoop calls iterate until it reports false, running body after each
+// successful call. The loop's status is that of the last body command, or
+// zero if the body never ran.
+func (s *Shell) runLoop(ctx context.Context, body *List, iterate func() (bool, error)) error {
+	s.loopDepth++
+	defer func() { s.loopDepth-- }()
+
+	status := 0
+	for {
+		ok, err := iterate()
+		if err != nil || !ok {
+			s.lastExitCode = status
+			if err != nil {
+				return err
+			}
+			return s.status()
+		}
+
+		stop, err := s.runLoopBody(ctx, body)
+		status = s.lastExitCode
+		if err != nil {
+			return err
+		}
+		if stop {
+			s.lastExitCode = status
+			return s.status()
+		}
+	}
+}
+
+func (s *Shell) runFor(ctx context.Context, clause *ForClause) error {
+	values := s.params
+	if clause.In {
+		var err error
+		if values, err = s.expandWords(clause.Words); err != nil {
+			return err
+		}
+	}
+
+	i := 0
+	return s.runLoop(ctx, clause.Body, func() (bool, error) {
+		if i >= len(values) {
+			return false, nil
+		}
+		i++
+		return true, s.setVar(clause.Name, values[i-1])
+	})
+}
+
+func (s *Shell) runArithFor(ctx context.Context, clause *ArithForClause) error {
+	if _, err := s.evalArith(clause.Init); err != nil {
+		return err
+	}
+
+	first := true
+	return s.runLoop(ctx, clause.Body, func() (bool, error) {
+		if !first {
+			if _, err := s.evalArith(clause.Post); err != nil {
+				return false, err
+			}
+		}
+		first = false
+
+		cond, err := s.expandWord(clause.Cond)
+		if err != nil || strings.TrimSpace(cond) == "" {
+			return err == nil, err
+		}
+		n, err := s.arith(cond)
+		return n != 0, err
+	})
+}
+
+// evalArith expands an arithmetic expression and evaluates it.
+func (s *Shell) evalArith(expr *Word) (int64, error) {
+	text, err := s.expandWord(expr)
+	if err != nil {
+		return 0, err
+	}
+	return s.arith(text)
+}
+
+// runArithCommand runs (( expr )), whose status is 0 when expr is non-zero
+// and 1 otherwise.
+func (s *Shell) runArithCommand(cmd *ArithCommand) error {
+	n, err := s.evalArith(cmd.Expr)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func (s *Shell) runWhile(ctx context.Context, clause *WhileClause) error {
+	return s.runLoop(ctx, clause.Body, func() (bool, error) {
+		if err := s.runList(ctx, clause.Cond); err != nil {
+			return false, err
+		}
+		return (s.lastExitCode == 0) != clause.Until, nil
+	})
+}
+
+// runCase runs the body of the first item with a pattern matching the word,
+// continuing as its terminator directs. Its status is zero if no pattern
+// matches.
+func (s *Shell) runCase(ctx context.Context, clause *CaseClause) error {
+	word, err := s.expandWord(clause.Word)
+	if err != nil {
+		return err
+	}
+	s.lastExitCode = 0
+
+	falling := false
+	for _, item := range clause.Items {
+		if !falling {
+			matched, err := s.caseMatches(item, word)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		if err := s.runList(ctx, item.Body); err != nil {
+			return err
+		}
+
+		switch item.Op {
+		case TokenSemicolonAnd:
+			falling = true
+		case TokenDoubleSemicolonAnd:
+			falling = false
+		default:
+			return s.status()
+		}
+	}
+
+	return s.status()
+}
+
+func (s *Shell) caseMatches(item *CaseItem, word string) (bool, error) {
+	for _, p := range item.Patterns {
+		pattern, err := s.expandPattern(p)
+		if err != nil {
+			return false, err
+		}
+		if pattern.Match(word) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// maxCallDepth bounds function recursion so that a runaway function fails
+// instead of exhausting the Go stack.
+const maxCallDepth = 1000
+
+// callFunction runs fn with args as its positional parameters. Variables
+// declared local are restored and break and continue cannot reach loops
+// in the caller.
+func (s *Shell) callFunction(ctx context.Context, fn *FuncDecl, args []string) error {
+	if s.callDepth >= maxCallDepth {
+		return fmt.Errorf("%s: maximum function nesting level exceeded (%d)", fn.Name, maxCallDepth)
+	}
+
+	params, loopDepth := s.params, s.loopDepth
+	s.params, s.loopDepth = args[1:], 0
+	s.locals = append(s.locals, map[string]*Variable{})
+	s.callDepth++
+
+	defer func() {
+		s.callDepth--
+		for name, saved := range s.locals[len(s.locals)-1] {
+			if saved == nil {
+				delete(s.vars, name)
+			} else {
+				s.vars[name] = saved
+			}
+		}
+		s.locals = s.locals[:len(s.locals)-1]
+		s.params, s.loopDepth = params, loopDepth
+	}()
+
+	err := s.runCompound(ctx, fn.Body)
+
+	var ret *returnControl
+	if errors.As(err, &ret) {
+		s.lastExitCode = ret.Status
+		return s.status()
+	}
+	return err
+}
+
+// runAsSubshell runs list in s, a copy made by subshell, and returns its
+// exit status. Control flow such as exit or return ends only the copy.
+func (s *Shell) runAsSubshell(ctx context.Context, list *List) int {
+	return s.subshellStatus(s.runList(ctx, list))
+}
+
+// subshellStatus returns the exit status of a subshell that ended with err,
+// which is nil or control flow that unwound it.
+func (s *Shell) subshellStatus(err error) int {
+	var exit *exitControl
+	var ret *returnControl
+	switch {
+	case errors.As(err, &exit):
+		return exit.Status
+	case errors.As(err, &ret):
+		return ret.Status
+	}
+	return s.lastExitCode
+}
+
+// runRedirected runs a compound command with its redirections.
+func (s *Shell) runRedirected(ctx context.Context, node *Redirected) error {
+	return s.withRedirects(node.Redirects, func() error {
+		return s.runCompound(ctx, node.Command)
+	})
+}
+
+// withRedirects runs fn with the shell's own standard streams redirected,
+// so that every command it runs inherits them.
+func (s *Shell) withRedirects(redirects []*Redirect, fn func() error) error {
+	if len(redirects) == 0 {
+		return fn()
+	}
+
+	streams := &exec.Cmd{Stdin: s.stdin, Stdout: s.stdout, Stderr: s.stderr}
+	for fd, f := range s.fds {
+		setFd(streams, fd, f)
+	}
+
+	files, err := s.executor.applyRedirects(streams, redirects)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	stdin, stdout, stderr, fds := s.stdin, s.stdout, s.stderr, s.fds
+	defer func() { s.stdin, s.stdout, s.stderr, s.fds = stdin, stdout, stderr, fds }()
+
+	s.fds = make(map[int]*os.File, len(streams.ExtraFiles))
+	for i, f := range streams.ExtraFiles {
+		if f != nil {
+			s.fds[i+3] = f
+		}
+	}
+
+	// Every stream is a file: the shell's own, one opened by a redirection
+	// or closedFile.
+	s.stdin = streams.Stdin.(*os.File)
+	s.stdout = streams.Stdout.(*os.File)
+	s.stderr = streams.Stderr.(*os.File)
+
+	return fn()
+}
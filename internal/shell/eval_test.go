@@ -0,0 +1,52 @@
+package shell
+
+import "testing"
+
+func TestRedirectFiles(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "file", script: "echo hi >out; cat out", want: "hi\n"},
+		{name: "append", script: "echo a >out; echo b >>out; cat <out", want: "a\nb\n"},
+		{name: "pipeline stages", script: "printf 'b\\na\\n' >in; sort <in | cat >out; cat out", want: "a\nb\n"},
+		{name: "missing input", script: "{ cat <missing; } 2>/dev/null; echo $?", want: "1\n"},
+	})
+}
+
+func TestGroupRedirections(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "group", script: "{ echo a; echo b; } >out; cat out", want: "a\nb\n"},
+		{name: "group fd", script: "{ echo hi >&3; } 3>out; cat out", want: "hi\n"},
+		{name: "function fd", script: "f() { echo x >&3; }; f 3>out; cat out", want: "x\n"},
+		{name: "external in group fd", script: "{ sh -c 'echo ext >&3'; } 3>out; cat out", want: "ext\n"},
+		{name: "nested fd", script: "{ { echo in >&3; } 4>other; } 3>out; cat out", want: "in\n"},
+		{name: "subshell fd", script: "( echo sub >&3 ) 3>&1", want: "sub\n"},
+		{name: "pipeline stage fd", script: "f() { echo y >&3; }; f 3>&1 | cat", want: "y\n"},
+		{name: "fd not kept after group", script: "{ true; } 3>out; echo no >&3", want: "Error: 3: bad file descriptor\n", status: 1},
+		{name: "closed fd", script: "{ { echo z >&3; } 3>&-; } 3>out", want: "Error: 3: bad file descriptor\n", status: 1},
+	})
+}
+
+func TestRedirectDescriptors(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "stderr to stdout", script: "sh -c 'echo err >&2' 2>&1 >/dev/null | cat", want: "err\n"},
+		{name: "stderr to file", script: "sh -c 'echo err >&2' 2>err; cat err", want: "err\n"},
+		{name: "both", script: "sh -c 'echo out; echo err >&2' &>all; cat all", want: "out\nerr\n"},
+		{name: "numbered input", script: "echo in >f; sh -c 'cat <&3' 3<f", want: "in\n"},
+		{name: "read-write", script: "echo rw >f; cat <>f", want: "rw\n"},
+		{name: "close stdout", script: "sh -c 'echo hi 2>/dev/null || echo closed >&2' >&-", want: "closed\n"},
+		{name: "close stdin", script: "sh -c 'read x 2>/dev/null || echo closed' <&-", want: "closed\n"},
+		{name: "duplicate closed", script: "echo hi >&- 2>&1", want: "Error: 1: bad file descriptor\n", status: 1},
+	})
+}
+
+func TestBackgroundJobs(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "and-or list", script: "false || echo ran & wait", want: "ran\n"},
+		{name: "negated status", script: "! true & wait $!; echo $?", want: "1\n"},
+		{name: "compound pid", script: "{ sleep 5; } & kill $!; wait $!; echo $?", want: "143\n"},
+		{name: "compound listed", script: "{ sleep 5; } & p=$!; jobs -p | grep -qx $p && echo listed; kill $p; wait", want: "listed\n"},
+		{name: "compound process group", script: "{ " + pgid + " >a; } & wait; [ $(cat a) = $! ] && echo same", want: "same\n"},
+		{name: "killed list", script: "sleep 5 && echo no & kill $!; wait $!; echo $?", want: "143\n"},
+		{name: "process substitution finished", script: "cat > >(cat >/dev/null; echo done >out) <<<bg & wait; " +
+			"for i in 1 2 3 4 5 6 7 8 9 10; do [ -s out ] && break; sleep 0.2; done; cat out", want: "done\n"},
+	})
+}
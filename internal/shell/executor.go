@@ -3,21 +3,96 @@ package shell
 import (
 	"context"
 	"io"
+	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"fmt"
 	"sync"
+	"unsafe"
 )
 
 type Executor struct {
     shell       *Shell
     mu          sync.Mutex
+    procSubsts  []*procSubst
+
+    // group is set in a subshell that runs as an internal stage, to the
+    // pipeline of that stage. The commands the subshell starts join its
+    // process group, as they would a forked subshell's.
+    group       *ProcessGroup
+}
+
+// procSubst is a running process substitution: the shell's end of its pipe,
+// which commands started meanwhile inherit, and a channel closed once its
+// commands have finished.
+type procSubst struct {
+    file *os.File
+    done chan struct{}
 }
 
 type ProcessGroup struct {
     Commands        []*exec.Cmd
     Pgid            int
     Cancel          context.CancelFunc
+    Status          []int
+    Background      bool
+
+    // foreground is set when the pipeline was given tty, the terminal the
+    // shell owned when it started, and the shell has to take it back.
+    tty             int
+    foreground      bool
+
+    // Internal stages have no process; their commands only hold their
+    // streams, and done is closed once they have finished. reaped marks
+    // the stages already waited for, should the pipeline stop midway.
+    internal        []func(*Shell) error
+    done            []chan struct{}
+    reaped          []bool
+
+    // A pipeline with internal stages is led by a process that stands in
+    // for the subshells they run in: it is stopped and continued with the
+    // pipeline, and lives until leaderIn is closed after the internal
+    // stages finish. Should a signal kill it, killed is closed and the
+    // stages end with signal.
+    leader          *exec.Cmd
+    leaderIn        *os.File
+    killed          chan struct{}
+    signal          syscall.Signal
+
+    // procSubsts are the process substitutions of a job, finished once it
+    // has been reaped.
+    procSubsts      []*procSubst
+}
+
+// lastPid returns the process ID of the last stage that was started, which
+// for an internal stage is that of the leader standing in for its
+// subshell, or 0 if none was.
+func (pg *ProcessGroup) lastPid() int {
+    pid := 0
+    for i, cmd := range pg.Commands {
+        switch {
+        case cmd.Process != nil:
+            pid = cmd.Process.Pid
+        case pg.internal[i] != nil && pg.leader != nil:
+            pid = pg.leader.Process.Pid
+        }
+    }
+    return pid
+}
+
+// stoppedError is returned when a pipeline that is waited for stops before
+// it finishes. Once continued, it can be waited for again.
+type stoppedError struct {
+    pg *ProcessGroup
+}
+
+func (e *stoppedError) Error() string {
+    return "stopped"
 }
 
 func NewExecutor(shell *Shell) *Executor {
@@ -27,52 +102,242 @@ func NewExecutor(shell *Shell) *Executor {
 }
 
 func (e *Executor) Execute(ctx context.Context, pipeline []Command) error {
-    e.mu.Lock()
-    defer e.mu.Unlock()
-
     if len(pipeline) == 0 {
         return nil
     }
 
+    pg, err := e.start(ctx, pipeline, false)
+    if err != nil {
+        return err
+    }
+
+    // The first stage may already have taken the terminal, so the shell
+    // takes it back whether or not it hands it over here.
+    if pg.foreground {
+        if pg.Pgid != 0 {
+            tcsetpgrp(pg.tty, pg.Pgid)
+        }
+        defer e.shell.reclaimTerminal(pg.tty)
+    }
+
+    err = e.wait(pg)
+    if _, stopped := err.(*stoppedError); !stopped {
+        e.shell.setPipeStatus(pg.Status)
+    }
+    return err
+}
+
+// Background starts the pipeline without waiting for it or handing it the
+// terminal. The caller reaps it with wait.
+func (e *Executor) Background(ctx context.Context, pipeline []Command) (*ProcessGroup, error) {
+    return e.start(ctx, pipeline, true)
+}
+
+// wait reaps the stages of the pipeline and returns its status, unless it
+// stops first.
+func (e *Executor) wait(pg *ProcessGroup) error {
+    err := e.waitCommands(pg)
+    if _, stopped := err.(*stoppedError); !stopped {
+        pg.Cancel()
+        e.shell.processGroup.Delete(pg.Pgid)
+    }
+    return err
+}
+
+// start prepares the stages of the pipeline, connects them and performs
+// their redirections, and starts them.
+func (e *Executor) start(ctx context.Context, pipeline []Command, background bool) (*ProcessGroup, error) {
     pg := &ProcessGroup{
-        Commands: make([]*exec.Cmd, len(pipeline)),
+        Commands:   make([]*exec.Cmd, len(pipeline)),
+        Background: background,
+        internal:   make([]func(*Shell) error, len(pipeline)),
+        done:       make([]chan struct{}, len(pipeline)),
+        reaped:     make([]bool, len(pipeline)),
+    }
+
+    // Whether the shell owns the terminal has to be found out before any
+    // stage can take it.
+    if !background {
+        pg.tty, pg.foreground = e.shell.terminal()
     }
 
     ctx, cancel := context.WithCancel(ctx)
     pg.Cancel = cancel
 
+    if e.group != nil {
+        pg.Pgid = e.group.Pgid
+    }
+
     for i, cmd := range pipeline {
+        if cmd.Internal != nil {
+            pg.internal[i] = cmd.Internal
+            pg.Commands[i] = &exec.Cmd{Stdin: e.shell.stdin, Stdout: e.shell.stdout, Stderr: e.shell.stderr}
+            continue
+        }
         execCmd := e.prepareCommand(ctx, cmd)
         pg.Commands[i] = execCmd
     }
 
-    if err := e.setupPipes(pg.Commands); err != nil {
-        return err
+    // The shell's copies of the pipes must be closed once the stages have
+    // started, or readers never see end of file.
+    files, err := e.setupPipes(pg.Commands)
+    defer func() {
+        for _, f := range files {
+            f.Close()
+        }
+    }()
+    if err != nil {
+        pg.Cancel()
+        return nil, err
+    }
+
+    // Internal stages perform their redirections themselves.
+    for i, cmd := range pipeline {
+        if cmd.Internal != nil {
+            continue
+        }
+        opened, err := e.applyRedirects(pg.Commands[i], cmd.Redirects)
+        files = append(files, opened...)
+        if err != nil {
+            pg.Cancel()
+            return nil, err
+        }
+    }
+
+    // Redirection targets may contain command substitutions that run
+    // pipelines of their own, so only take the lock once they are open.
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    if e.group == nil && hasInternal(pg) {
+        if err := e.startLeader(pg); err != nil {
+            pg.Cancel()
+            return nil, err
+        }
     }
 
     if err := e.startCommands(pg); err != nil {
         pg.Cancel()
-        return err
+        if pg.leader != nil {
+            pg.leaderIn.Close()
+            pg.leader.Wait()
+        }
+        if pg.foreground {
+            e.shell.reclaimTerminal(pg.tty)
+        }
+        return nil, err
+    }
+
+    if pg.leader != nil {
+        go func() {
+            for _, done := range pg.done {
+                if done != nil {
+                    <-done
+                }
+            }
+            pg.leaderIn.Close()
+        }()
     }
 
     e.shell.processGroup.Store(pg.Pgid, pg)
+    return pg, nil
+}
+
+// hasInternal reports whether a stage of the pipeline runs in the shell.
+func hasInternal(pg *ProcessGroup) bool {
+    for _, fn := range pg.internal {
+        if fn != nil {
+            return true
+        }
+    }
+    return false
+}
+
+// groupLeaderEnv is set in the environment of a pipeline's leader, which is
+// the shell's own executable.
+const groupLeaderEnv = "GOSH_GROUP_LEADER"
+
+// A group leader does nothing but wait for its stdin to be closed.
+func init() {
+    if os.Getenv(groupLeaderEnv) != "" {
+        io.Copy(io.Discard, os.Stdin)
+        os.Exit(0)
+    }
+}
+
+// startLeader starts the leader of a pipeline with internal stages, whose
+// process group the stages' commands join, and hands it the terminal if
+// the pipeline runs in the foreground.
+func (e *Executor) startLeader(pg *ProcessGroup) error {
+    exe, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    r, w, err := os.Pipe()
+    if err != nil {
+        return err
+    }
+    defer r.Close()
 
-    return e.waitCommands(pg)
+    leader := exec.Command(exe)
+    leader.Env = []string{groupLeaderEnv + "=1"}
+    leader.Stdin = r
+    leader.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := leader.Start(); err != nil {
+        w.Close()
+        return fmt.Errorf("failed to start process group: %w", err)
+    }
+
+    pg.leader, pg.leaderIn = leader, w
+    pg.killed = make(chan struct{})
+    pg.Pgid = leader.Process.Pid
+    if pg.foreground {
+        tcsetpgrp(pg.tty, pg.Pgid)
+    }
+    return nil
 }
 
+// startCommands starts every stage of the pipeline in one process group:
+// that of its leader or of the stage a subshell runs in, if there is one,
+// and otherwise one led by the first stage. When the shell owns the
+// terminal and the first stage of a foreground pipeline reads from it, the
+// stage takes the terminal over itself before it runs, so that it is not
+// stopped reading before the shell hands it over.
+//
+// A stage of a longer pipeline that cannot be started is reported and gets
+// its status, and the others run without it.
 func (e *Executor) startCommands(pg *ProcessGroup) error {
+	pg.Status = make([]int, len(pg.Commands))
+
 	for i, cmd := range pg.Commands {
-			if i == 0 {
-					cmd.SysProcAttr = &syscall.SysProcAttr{
-						Setpgid: true,
-					}
+			if pg.internal[i] != nil {
+				if err := e.startInternal(pg, i); err != nil {
+					fmt.Fprintf(e.shell.stderr, "Error: %v\n", err)
+					pg.Status[i] = exitCode(err)
+				}
+				continue
+			}
+
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Setpgid: true,
+				Pgid:    pg.Pgid,
+			}
+			if pg.Pgid == 0 && pg.foreground && cmd.Stdin == e.shell.stdin {
+				cmd.SysProcAttr.Foreground = true
+				cmd.SysProcAttr.Ctty = 0
 			}
 
 			if err := cmd.Start(); err != nil {
-				return fmt.Errorf("failed to start command: %w", err)
+				err = fmt.Errorf("failed to start command: %w", err)
+				if len(pg.Commands) == 1 {
+					return err
+				}
+				fmt.Fprintf(e.shell.stderr, "Error: %v\n", err)
+				pg.Status[i] = exitCode(err)
+				continue
 			}
 
-			if i == 0 {
+			if pg.Pgid == 0 {
 			    pg.Pgid = cmd.Process.Pid
 			}
 	}
@@ -80,40 +345,559 @@ func (e *Executor) startCommands(pg *ProcessGroup) error {
     return nil
 }
 
+// waitCommands reaps every stage of the pipeline and returns its status:
+// that of the last stage or, with pipefail, of the rightmost stage that
+// failed. If a stage stops, it returns a *stoppedError instead.
 func (e *Executor) waitCommands(pg *ProcessGroup) error {
-	for _, cmd := range pg.Commands {
-			if err := cmd.Wait(); err != nil {
-					return err
+	if pg.leader != nil && pg.leader.ProcessState == nil {
+			if stopped, _ := waitProcess(pg.leader); stopped {
+					return &stoppedError{pg: pg}
+			}
+			if ws, ok := pg.leader.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+					pg.kill(ws.Signal())
+			}
+	}
+
+	for i, cmd := range pg.Commands {
+			if pg.reaped[i] {
+					continue
+			}
+			switch {
+			case pg.done[i] != nil:
+					<-pg.done[i]
+					if pg.signal != 0 {
+							pg.Status[i] = 128 + int(pg.signal)
+					}
+			case cmd.Process != nil:
+					stopped, err := waitProcess(cmd)
+					// In a subshell, the pipeline of the stage it runs in
+					// stops instead, and the shell that started it waits.
+					for stopped && e.group != nil {
+							stopped, err = waitProcess(cmd)
+					}
+					if stopped {
+							return &stoppedError{pg: pg}
+					}
+					pg.Status[i] = exitCode(err)
+			}
+			pg.reaped[i] = true
+	}
+
+	status := pg.Status[len(pg.Status)-1]
+	if e.shell.setopts["pipefail"] {
+			for _, code := range pg.Status {
+					if code != 0 {
+							status = code
+					}
 			}
 	}
 	
+    if status == 0 {
+        return nil
+    }
+    return exitStatus(status)
+}
+
+// kill ends a pipeline whose leader sig killed, as it would have killed the
+// subshells of other shells: the stages' commands get sig too, and its
+// internal stages run no more commands.
+func (pg *ProcessGroup) kill(sig syscall.Signal) {
+    pg.signal = sig
+    syscall.Kill(-pg.Pgid, sig)
+    close(pg.killed)
+}
+
+// killed returns the control flow that ends a subshell running as a stage of
+// a pipeline that has been killed, and nil otherwise.
+func (e *Executor) killed() error {
+    if e.group == nil {
+        return nil
+    }
+    select {
+    case <-e.group.killed:
+        return &exitControl{Status: 128 + int(e.group.signal)}
+    default:
+        return nil
+    }
+}
+
+// startInternal runs an internal stage in a subshell of its own, as other
+// shells fork for it. The subshell gets duplicates of the stage's streams,
+// so that they stay open after the shell has closed its copies. The
+// commands of a background job's stage would be stopped reading from the
+// terminal while the job still ran, so it reads from the null device
+// instead.
+func (e *Executor) startInternal(pg *ProcessGroup, i int) error {
+    cmd := pg.Commands[i]
+
+    stdin := cmd.Stdin
+    if _, tty := e.shell.terminal(); tty && pg.Background && stdin == e.shell.stdin {
+        stdin = nil
+    }
+
+    var streams []*os.File
+    for _, v := range []interface{}{stdin, cmd.Stdout, cmd.Stderr} {
+        f, err := dupStream(v)
+        if err != nil {
+            for _, f := range streams {
+                f.Close()
+            }
+            return err
+        }
+        streams = append(streams, f)
+    }
+
+    // The stage sees the shell's jobs, as jobs | cat should list them.
+    sub := e.shell.subshell()
+    sub.jobs = e.shell.jobs
+    if e.group == nil {
+        sub.executor.group = pg
+    }
+    sub.stdin, sub.stdout, sub.stderr = streams[0], streams[1], streams[2]
+
+    pg.done[i] = make(chan struct{})
+    go func() {
+        err := pg.internal[i](sub)
+        if !isControlFlow(err) {
+            sub.setStatus(err)
+        }
+        pg.Status[i] = sub.subshellStatus(err)
+
+        for _, f := range streams {
+            f.Close()
+        }
+        close(pg.done[i])
+    }()
+
     return nil
 }
 
-func (e *Executor) prepareCommand(ctx context.Context, cmd Command) *exec.Cmd {
-    execCmd := exec.CommandContext(ctx, cmd.Args[0], cmd.Args[1:]...)
-    
-    execCmd.SysProcAttr = &syscall.SysProcAttr{
-        Setpgid: true,
+// waitProcess waits for the process of cmd to exit, which it reaps, or to
+// stop, which it reports. The process is only looked at until it exits,
+// so that cmd.Wait can reap it and release what it holds.
+func waitProcess(cmd *exec.Cmd) (bool, error) {
+    pid := cmd.Process.Pid
+
+    for {
+        var info siginfo
+        _, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPid, uintptr(pid), uintptr(unsafe.Pointer(&info)),
+            syscall.WEXITED|syscall.WSTOPPED|syscall.WNOWAIT, 0, 0)
+        if errno == syscall.EINTR {
+            continue
+        }
+        if errno != 0 || info.Code != cldStopped {
+            return false, cmd.Wait()
+        }
+
+        // Take the stop off the process, so that it is reported once.
+        syscall.Syscall6(syscall.SYS_WAITID, pPid, uintptr(pid), uintptr(unsafe.Pointer(&info)), syscall.WSTOPPED, 0, 0)
+        return true, nil
+    }
+}
+
+// siginfo is the start of the siginfo_t filled in by waitid.
+type siginfo struct {
+    Signo int32
+    Errno int32
+    Code  int32
+    _     [116]byte
+}
+
+const (
+    pPid       = 1 // P_PID: wait for the process with the given ID
+    cldStopped = 5 // CLD_STOPPED: the child was stopped by a signal
+)
+
+// dupStream duplicates a stream of a stage. A closed stream stays closed,
+// and a missing one becomes the null device.
+func dupStream(v interface{}) (*os.File, error) {
+    f, ok := v.(*os.File)
+    if f == closedFile {
+        return f, nil
+    }
+    if !ok || f == nil {
+        return os.OpenFile(os.DevNull, os.O_RDWR, 0)
     }
 
-    if cmd.Env != nil {
-        execCmd.Env = cmd.Env
+    fd, err := syscall.Dup(int(f.Fd()))
+    if err != nil {
+        return nil, err
     }
+    syscall.CloseOnExec(fd)
+    return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+func (e *Executor) prepareCommand(ctx context.Context, cmd Command) *exec.Cmd {
+    execCmd := exec.CommandContext(ctx, cmd.Args[0], cmd.Args[1:]...)
+    execCmd.Stdout = e.shell.stdout
+    execCmd.Stderr = e.shell.stderr
+    execCmd.Dir = e.shell.workDir
+    execCmd.Env = cmd.Env
+
+    execCmd.Stdin = e.shell.stdin
 
     if cmd.Dir != "" {
         execCmd.Dir = cmd.Dir
     }
 
+    for fd, f := range e.shell.fds {
+        setFd(execCmd, fd, f)
+    }
+
+    // Process substitutions are named by the shell's own descriptors, so
+    // they are passed on under the same numbers.
+    for _, ps := range e.procSubsts {
+        setFd(execCmd, int(ps.file.Fd()), ps.file)
+    }
+
+    // exec.Command searched the process's PATH; the command's own is the
+    // one that counts.
+    execCmd.Path, execCmd.Err = lookPath(cmd.Args[0], execCmd.Dir, execCmd.Env)
+
     return execCmd
 }
 
-func (e *Executor) setupPipes(cmds []*exec.Cmd) error {
+// lookPath finds the executable for name in the PATH of env, or of the
+// process if env is nil. Names containing a slash are used as they are.
+func lookPath(name, dir string, env []string) (string, error) {
+    if strings.Contains(name, "/") {
+        return name, nil
+    }
+
+    path := os.Getenv("PATH")
+    if env != nil {
+        path = ""
+        for _, kv := range env {
+            if strings.HasPrefix(kv, "PATH=") {
+                path = kv[len("PATH="):]
+            }
+        }
+    }
+
+    for _, d := range filepath.SplitList(path) {
+        if d == "" {
+            d = "."
+        }
+        if !filepath.IsAbs(d) {
+            d = filepath.Join(dir, d)
+        }
+        file := filepath.Join(d, name)
+        if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+            return file, nil
+        }
+    }
+
+    return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// startProcSubst runs list in a subshell with its stdout, or for >(...)
+// its stdin, connected to a pipe, and returns a /dev/fd path for the other
+// end. The subshell runs concurrently with the command using the path.
+func (e *Executor) startProcSubst(list *List, output bool) (string, error) {
+    r, w, err := os.Pipe()
+    if err != nil {
+        return "", err
+    }
+
+    sub := e.shell.subshell()
+    ps := &procSubst{file: r, done: make(chan struct{})}
+    remote := w
+    if output {
+        sub.stdin = r
+        ps.file, remote = w, r
+    } else {
+        sub.stdout = w
+    }
+
+    go func() {
+        sub.runAsSubshell(context.Background(), list)
+        remote.Close()
+        close(ps.done)
+    }()
+
+    e.procSubsts = append(e.procSubsts, ps)
+    return fmt.Sprintf("/dev/fd/%d", ps.file.Fd()), nil
+}
+
+// finishProcSubsts finishes the process substitutions started since the
+// first mark of them.
+func (e *Executor) finishProcSubsts(mark int) {
+    for _, ps := range e.takeProcSubsts(mark) {
+        ps.finish()
+    }
+}
+
+// takeProcSubsts removes the process substitutions started since the first
+// mark of them, so that commands started later do not inherit them, and
+// returns them.
+func (e *Executor) takeProcSubsts(mark int) []*procSubst {
+    taken := slices.Clone(e.procSubsts[mark:])
+    e.procSubsts = e.procSubsts[:mark]
+    return taken
+}
+
+// finish closes the shell's end of the process substitution, which ends
+// its input or output, and waits for its commands to finish.
+func (ps *procSubst) finish() {
+    ps.file.Close()
+    <-ps.done
+}
+
+// setupPipes connects each stage's stdout to the next stage's stdin with an
+// OS pipe, so the stages exchange data directly, and returns the pipe ends,
+// which the caller closes once the stages have started.
+func (e *Executor) setupPipes(cmds []*exec.Cmd) ([]*os.File, error) {
+    var files []*os.File
     for i := 0; i < len(cmds) - 1; i++ {
-        r, w := io.Pipe()
+        r, w, err := os.Pipe()
+        if err != nil {
+            return files, err
+        }
+        files = append(files, r, w)
         cmds[i].Stdout = w
         cmds[i+1].Stdin = r
     }
     
+    return files, nil
+}
+
+// applyRedirects performs the redirections of one pipeline stage in order,
+// after its pipes are wired, so that "2>&1 >file" and ">file 2>&1" differ
+// the same way they do in other shells.
+func (e *Executor) applyRedirects(execCmd *exec.Cmd, redirects []*Redirect) ([]*os.File, error) {
+    var files []*os.File
+
+    for _, r := range redirects {
+        if r.Op == TokenRedirectDupIn || r.Op == TokenRedirectDupOut {
+            if err := e.dupRedirect(execCmd, r); err != nil {
+                return files, err
+            }
+            continue
+        }
+
+        file, err := e.openRedirect(r)
+        if err != nil {
+            return files, err
+        }
+        files = append(files, file)
+
+        if err := setFd(execCmd, r.Fd, file); err != nil {
+            return files, err
+        }
+        if r.Op == TokenRedirectAll || r.Op == TokenRedirectAllAppend {
+            execCmd.Stderr = file
+        }
+    }
+
+    return files, nil
+}
+
+func (e *Executor) dupRedirect(execCmd *exec.Cmd, r *Redirect) error {
+    target, err := e.shell.expandWord(r.Target)
+    if err != nil {
+        return err
+    }
+
+    if target == "-" {
+        return setFd(execCmd, r.Fd, nil)
+    }
+
+    src, err := strconv.Atoi(target)
+    if err != nil {
+        return fmt.Errorf("%s: ambiguous redirect", target)
+    }
+
+    file, ok := getFd(execCmd, src)
+    if !ok {
+        return fmt.Errorf("%d: bad file descriptor", src)
+    }
+
+    return setFd(execCmd, r.Fd, file)
+}
+
+func (e *Executor) openRedirect(r *Redirect) (*os.File, error) {
+    if r.Op == TokenHeredoc {
+        body, err := e.shell.expandHeredoc(r.Target)
+        if err != nil {
+            return nil, err
+        }
+        return heredocFile(body)
+    }
+
+    path, err := e.shell.expandWord(r.Target)
+    if err != nil {
+        return nil, err
+    }
+
+    switch r.Op {
+    case TokenHereString:
+        return heredocFile(path + "\n")
+    }
+
+    path = e.shell.resolvePath(path)
+
+    switch r.Op {
+    case TokenRedirectIn:
+        file, err := os.Open(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open input file: %w", err)
+        }
+        return file, nil
+
+    case TokenRedirectReadWrite:
+        file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open file: %w", err)
+        }
+        return file, nil
+
+    default:
+        flag := os.O_CREATE | os.O_WRONLY
+        if r.Op == TokenRedirectAppend || r.Op == TokenRedirectAllAppend {
+            flag |= os.O_APPEND
+        } else {
+            flag |= os.O_TRUNC
+        }
+
+        file, err := os.OpenFile(path, flag, 0644)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open output file: %w", err)
+        }
+        return file, nil
+    }
+}
+
+// heredocFile returns the read end of a pipe that is fed content from a
+// separate goroutine, so bodies larger than the pipe buffer do not block.
+func heredocFile(content string) (*os.File, error) {
+    r, w, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+
+    go func() {
+        io.WriteString(w, content)
+        w.Close()
+    }()
+
+    return r, nil
+}
+
+// getFd returns what file descriptor fd of the command currently refers to.
+func getFd(execCmd *exec.Cmd, fd int) (interface{}, bool) {
+    var f interface{}
+
+    switch {
+    case fd == 0:
+        f = execCmd.Stdin
+    case fd == 1:
+        f = execCmd.Stdout
+    case fd == 2:
+        f = execCmd.Stderr
+    case fd >= 3 && fd-3 < len(execCmd.ExtraFiles) && execCmd.ExtraFiles[fd-3] != nil:
+        f = execCmd.ExtraFiles[fd-3]
+    }
+
+    return f, f != nil && f != interface{}(closedFile)
+}
+
+// closedFile stands for a closed standard descriptor. exec.Cmd would
+// connect a nil stream to the null device, but it passes on the invalid
+// descriptor of a closed file, which the child then closes; the shell's
+// own writes to it fail.
+var closedFile = func() *os.File {
+    f, err := os.Open(os.DevNull)
+    if err != nil {
+        panic(err)
+    }
+    f.Close()
+    return f
+}()
+
+// setFd points file descriptor fd of the command at f. A nil f closes the
+// descriptor.
+func setFd(execCmd *exec.Cmd, fd int, f interface{}) error {
+    if f == nil && fd >= 0 && fd <= 2 {
+        f = closedFile
+    }
+
+    switch {
+    case fd < 0:
+        return fmt.Errorf("%d: bad file descriptor", fd)
+
+    case fd == 0:
+        r, ok := f.(io.Reader)
+        if !ok {
+            return fmt.Errorf("0: file descriptor not open for reading")
+        }
+        execCmd.Stdin = r
+
+    case fd <= 2:
+        w, ok := f.(io.Writer)
+        if !ok {
+            return fmt.Errorf("%d: file descriptor not open for writing", fd)
+        }
+        if fd == 1 {
+            execCmd.Stdout = w
+        } else {
+            execCmd.Stderr = w
+        }
+
+    default:
+        var file *os.File
+        if f != nil {
+            var ok bool
+            if file, ok = f.(*os.File); !ok {
+                return fmt.Errorf("%d: cannot duplicate a pipe onto this descriptor", fd)
+            }
+        }
+        for len(execCmd.ExtraFiles) <= fd-3 {
+            execCmd.ExtraFiles = append(execCmd.ExtraFiles, nil)
+        }
+        execCmd.ExtraFiles[fd-3] = file
+    }
+
+    return nil
+}
+
+// terminal returns the descriptor of the terminal the shell reads commands
+// from, and whether the shell controls it and so should hand it to the
+// pipelines it runs in the foreground.
+func (s *Shell) terminal() (int, bool) {
+    if !s.interactive || s.stdin != os.Stdin {
+        return 0, false
+    }
+    fd := int(s.stdin.Fd())
+    pgid, err := tcgetpgrp(fd)
+    return fd, err == nil && pgid == syscall.Getpgrp()
+}
+
+// reclaimTerminal makes the shell's process group the foreground group of
+// the terminal again, once the group it handed it to has exited or stopped.
+func (s *Shell) reclaimTerminal(fd int) {
+    tcsetpgrp(fd, syscall.Getpgrp())
+}
+
+func tcgetpgrp(fd int) (int, error) {
+    var pgid int32
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+    if errno != 0 {
+        return 0, errno
+    }
+    return int(pgid), nil
+}
+
+// tcsetpgrp makes pgid the foreground process group of the terminal. The
+// shell is in the background when it takes the terminal back, so SIGTTOU,
+// which would stop it, is ignored for the call.
+func tcsetpgrp(fd, pgid int) error {
+    signal.Ignore(syscall.SIGTTOU)
+    defer signal.Reset(syscall.SIGTTOU)
+
+    p := int32(pgid)
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&p)))
+    if errno != 0 {
+        return errno
+    }
     return nil
 }
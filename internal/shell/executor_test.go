@@ -0,0 +1,14 @@
+package shell
+
+import "testing"
+
+// pgid prints the process group of a command run from a pipeline stage.
+const pgid = `sh -c 'cut -d" " -f5 /proc/$$/stat'`
+
+func TestPipelineProcessGroup(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "internal last stage", script: pgid + " >a | { " + pgid + " >b; }; cmp -s a b && echo same", want: "same\n"},
+		{name: "internal first stage", script: "{ " + pgid + " >a; } | " + pgid + " >b; cmp -s a b && echo same", want: "same\n"},
+		{name: "nested", script: "{ { " + pgid + " >a; } | cat; } | { " + pgid + " >b; }; cmp -s a b && echo same", want: "same\n"},
+	})
+}
@@ -0,0 +1,868 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gosh/internal/glob"
+)
+
+const defaultIFS = " \t\n"
+
+// expansion accumulates the fields a word expands to. A field is open once
+// anything, even an empty quoted string, has been written to it. Alongside
+// each field it builds a pattern in which quoted text is escaped.
+type expansion struct {
+	fields   []string
+	patterns []string
+	current  strings.Builder
+	pattern  strings.Builder
+	open     bool
+}
+
+func (x *expansion) write(s string, quoted bool) {
+	x.current.WriteString(s)
+	if quoted {
+		x.pattern.WriteString(glob.QuoteMeta(s))
+	} else {
+		x.pattern.WriteString(s)
+	}
+	x.open = true
+}
+
+func (x *expansion) endField() {
+	if x.open {
+		x.fields = append(x.fields, x.current.String())
+		x.patterns = append(x.patterns, x.pattern.String())
+		x.current.Reset()
+		x.pattern.Reset()
+		x.open = false
+	}
+}
+
+// writeSplit writes the result of an unquoted expansion, breaking it into
+// fields on the characters of ifs. A separator is a run of IFS whitespace
+// with at most one other IFS character in it; only the latter can delimit
+// an empty field.
+func (x *expansion) writeSplit(value, ifs string) {
+	for i := 0; i < len(value); i++ {
+		if strings.IndexByte(ifs, value[i]) < 0 {
+			x.write(value[i:i+1], false)
+			continue
+		}
+
+		j := i
+		delimiter := false
+		for j < len(value) && strings.IndexByte(ifs, value[j]) >= 0 {
+			if strings.IndexByte(defaultIFS, value[j]) < 0 {
+				if delimiter {
+					break
+				}
+				delimiter = true
+			}
+			j++
+		}
+
+		if delimiter {
+			x.open = true
+		}
+		x.endField()
+		i = j - 1
+	}
+}
+
+// lookupParam resolves any parameter name accepted by the parser: a
+// variable, a positional parameter, or one of $#, $@ and $*.
+func (s *Shell) lookupParam(name string) (string, bool) {
+	switch name {
+	case "#":
+		return strconv.Itoa(len(s.params)), true
+	case "@", "*":
+		return strings.Join(s.params, " "), len(s.params) > 0
+	case "?":
+		return strconv.Itoa(s.lastExitCode), true
+	case "$":
+		return strconv.Itoa(s.pid), true
+	case "!":
+		if s.lastBgPid == 0 {
+			return "", false
+		}
+		return strconv.Itoa(s.lastBgPid), true
+	case "-":
+		return s.optionFlags(), true
+	case "0":
+		return os.Args[0], true
+	case "_":
+		return s.lastArg, true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(s.params) {
+			return "", false
+		}
+		return s.params[n-1], true
+	}
+
+	if !isName(name) {
+		return "", false
+	}
+	return s.lookupVar(name)
+}
+
+// optionFlags returns the value of $-, the single-letter options in
+// effect. Brace expansion is always enabled.
+func (s *Shell) optionFlags() string {
+	flags := "B"
+	if s.interactive {
+		flags += "i"
+	}
+	return flags
+}
+
+func isName(name string) bool {
+	return name != "" && extractVariableName(name) == name
+}
+
+func (s *Shell) ifs() string {
+	if ifs, ok := s.lookupVar("IFS"); ok {
+		return ifs
+	}
+	return defaultIFS
+}
+
+// expandWords expands command arguments. Brace expansion comes first, then
+// the expansions of expand, and finally pathname expansion of every field
+// that still contains unquoted pattern characters.
+func (s *Shell) expandWords(words []*Word) ([]string, error) {
+	var expanded []*Word
+	for _, word := range words {
+		expanded = append(expanded, expandBraces(word)...)
+	}
+
+	args := make([]string, 0, len(expanded))
+	for _, word := range expanded {
+		x, err := s.expand(word, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, field := range x.fields {
+			matches, err := s.globField(field, x.patterns[i])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, matches...)
+		}
+	}
+	return args, nil
+}
+
+// declarationBuiltins take assignments as arguments. Those are expanded
+// like assignments, without field splitting or pathname expansion.
+var declarationBuiltins = map[string]bool{
+	"declare": true, "export": true, "local": true, "readonly": true,
+}
+
+// isDeclaration reports whether word names one of declarationBuiltins.
+func isDeclaration(word *Word) bool {
+	if len(word.Parts) != 1 {
+		return false
+	}
+	lit, ok := word.Parts[0].(*Lit)
+	return ok && declarationBuiltins[lit.Value]
+}
+
+// expandArgs expands the words of a simple command.
+func (s *Shell) expandArgs(words []*Word) ([]string, error) {
+	if len(words) == 0 || !isDeclaration(words[0]) {
+		return s.expandWords(words)
+	}
+
+	args := []string{words[0].Parts[0].(*Lit).Value}
+	for _, word := range words[1:] {
+		name, value, ok := splitAssignment(word)
+		if !ok {
+			fields, err := s.expandWords([]*Word{word})
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, fields...)
+			continue
+		}
+
+		expanded, err := s.expandWord(value)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, name+"="+expanded)
+	}
+	return args, nil
+}
+
+func (s *Shell) globField(field, pattern string) ([]string, error) {
+	if !glob.HasMeta(pattern) {
+		return []string{field}, nil
+	}
+
+	matches := glob.Expand(pattern, s.workDir, glob.Options{
+		DotGlob:  s.shopts["dotglob"],
+		GlobStar: s.shopts["globstar"],
+	})
+
+	switch {
+	case len(matches) > 0:
+		return matches, nil
+	case s.shopts["failglob"]:
+		return nil, fmt.Errorf("no match: %s", field)
+	case s.shopts["nullglob"]:
+		return nil, nil
+	}
+	return []string{field}, nil
+}
+
+// expandWord expands a word that must stay a single string, such as a
+// redirection target or a here-document body.
+func (s *Shell) expandWord(word *Word) (string, error) {
+	fields, err := s.expandFields(word, false)
+	if err != nil || len(fields) == 0 {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+func (s *Shell) expandFields(word *Word, split bool) ([]string, error) {
+	x, err := s.expand(word, split)
+	if err != nil {
+		return nil, err
+	}
+	return x.fields, nil
+}
+
+// expand performs tilde expansion, parameter expansion, command
+// substitution, field splitting when split is set, and quote removal.
+// Without split the word always yields exactly one field.
+func (s *Shell) expand(word *Word, split bool) (*expansion, error) {
+	x := &expansion{}
+
+	parts := word.Parts
+	if dir, rest, ok := s.expandTilde(parts); ok {
+		x.write(dir, true)
+		parts = rest
+	}
+
+	if err := s.expandParts(x, parts, false, split); err != nil {
+		return nil, err
+	}
+
+	if !split {
+		x.open = true
+	}
+	x.endField()
+
+	return x, nil
+}
+
+// expandHeredoc expands a here-document body. It is expanded like a word
+// that is not split, except that a leading '~' is left alone.
+func (s *Shell) expandHeredoc(word *Word) (string, error) {
+	x := &expansion{}
+	if err := s.expandParts(x, word.Parts, false, false); err != nil {
+		return "", err
+	}
+	x.open = true
+	x.endField()
+	return x.fields[0], nil
+}
+
+// expandTilde expands a tilde-prefix at the start of parts: the unquoted
+// characters from '~' up to the first '/'. It returns the directory and the
+// remaining parts, or false if there is no prefix or it cannot be resolved.
+func (s *Shell) expandTilde(parts []WordPart) (string, []WordPart, bool) {
+	if len(parts) == 0 {
+		return "", nil, false
+	}
+	lit, ok := parts[0].(*Lit)
+	if !ok || !strings.HasPrefix(lit.Value, "~") {
+		return "", nil, false
+	}
+
+	prefix, rest, found := strings.Cut(lit.Value[1:], "/")
+	if !found && len(parts) > 1 {
+		return "", nil, false
+	}
+
+	var dir string
+	switch prefix {
+	case "":
+		if home, ok := s.lookupVar("HOME"); ok {
+			dir = home
+		} else if u, err := user.Current(); err == nil {
+			dir = u.HomeDir
+		} else {
+			return "", nil, false
+		}
+	case "+":
+		dir = s.workDir
+	case "-":
+		if dir, ok = s.lookupVar("OLDPWD"); !ok {
+			return "", nil, false
+		}
+	default:
+		u, err := user.Lookup(prefix)
+		if err != nil {
+			return "", nil, false
+		}
+		dir = u.HomeDir
+	}
+
+	remaining := parts[1:]
+	if found {
+		remaining = append([]WordPart{&Lit{Value: "/" + rest}}, remaining...)
+	}
+	return dir, remaining, true
+}
+
+func (s *Shell) expandParts(x *expansion, parts []WordPart, quoted, split bool) error {
+	for _, part := range parts {
+		switch part := part.(type) {
+		case *Lit:
+			x.write(part.Value, quoted)
+
+		case *SglQuoted:
+			x.write(part.Value, true)
+
+		case *DblQuoted:
+			// "$@" with no parameters expands to no field at all, and so
+			// does "${name[@]}" with no elements.
+			if len(part.Parts) != 1 || !expandsToList(part.Parts[0]) {
+				x.open = true
+			}
+			if err := s.expandParts(x, part.Parts, true, split); err != nil {
+				return err
+			}
+
+		case *ParamExp:
+			if expandsToList(part) {
+				values, err := s.expandList(part)
+				if err != nil {
+					return err
+				}
+				s.writeList(x, values, listSubscript(part) == "*", quoted, split)
+				continue
+			}
+
+			value, err := s.expandParam(part)
+			if err != nil {
+				return err
+			}
+			s.writeExpansion(x, value, quoted, split)
+
+		case *ArithExp:
+			n, err := s.evalArith(part.Expr)
+			if err != nil {
+				return err
+			}
+			s.writeExpansion(x, strconv.FormatInt(n, 10), quoted, split)
+
+		case *ProcSubst:
+			path, err := s.executor.startProcSubst(part.List, part.Output)
+			if err != nil {
+				return err
+			}
+			x.write(path, true)
+
+		case *CmdSubst:
+			out, err := s.commandSubst(part.List)
+			if err != nil {
+				return err
+			}
+			s.writeExpansion(x, out, quoted, split)
+		}
+	}
+
+	return nil
+}
+
+// listSubscript returns "@" or "*" if exp refers to every positional
+// parameter or every element of an array, and "" otherwise.
+func listSubscript(exp *ParamExp) string {
+	if exp.Index == nil {
+		if exp.Name == "@" || exp.Name == "*" {
+			return exp.Name
+		}
+		return ""
+	}
+
+	if len(exp.Index.Parts) == 1 {
+		if lit, ok := exp.Index.Parts[0].(*Lit); ok && (lit.Value == "@" || lit.Value == "*") {
+			return lit.Value
+		}
+	}
+	return ""
+}
+
+// expandsToList reports whether part is an expansion such as $@ or
+// ${name[@]} that yields a list of words, each transformed by its
+// operator, if any.
+func expandsToList(part WordPart) bool {
+	exp, ok := part.(*ParamExp)
+	if !ok || listSubscript(exp) == "" || exp.Length {
+		return false
+	}
+
+	switch exp.Op {
+	case "", ":", "#", "##", "%", "%%", "/", "//", "/#", "/%", "^^", "^", ",,", ",":
+		return true
+	}
+	return false
+}
+
+// writeList writes the words of a list expansion. Quoted, "$@" yields one
+// field per word and "$*" a single field joined by the first character of
+// IFS; unquoted, both yield every word split in turn.
+func (s *Shell) writeList(x *expansion, values []string, star, quoted, split bool) {
+	switch {
+	case !split:
+		x.write(strings.Join(values, " "), quoted)
+
+	case quoted && star:
+		sep := ""
+		if ifs := s.ifs(); ifs != "" {
+			sep = ifs[:1]
+		}
+		x.write(strings.Join(values, sep), true)
+
+	default:
+		for i, value := range values {
+			if i > 0 {
+				x.endField()
+			}
+			s.writeExpansion(x, value, quoted, split)
+		}
+	}
+}
+
+// listElements returns the elements $@ or ${name[@]} refers to, or with
+// ${!name[@]} the keys of the array as values.
+func (s *Shell) listElements(exp *ParamExp) []element {
+	var elems []element
+
+	switch {
+	case exp.Name == "@" || exp.Name == "*":
+		for i, param := range s.params {
+			elems = append(elems, element{Index: i + 1, Key: strconv.Itoa(i + 1), Value: param})
+		}
+
+	default:
+		if v, ok := s.vars[exp.Name]; ok {
+			elems = v.elements()
+		}
+	}
+
+	if exp.Keys {
+		for i := range elems {
+			elems[i].Value = elems[i].Key
+		}
+	}
+	return elems
+}
+
+// expandList expands a part for which expandsToList is true.
+func (s *Shell) expandList(exp *ParamExp) ([]string, error) {
+	elems := s.listElements(exp)
+
+	if exp.Op == ":" {
+		var err error
+		if elems, err = s.slice(exp, elems); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]string, len(elems))
+	for i, e := range elems {
+		values[i] = e.Value
+		if exp.Op != "" && exp.Op != ":" {
+			value, err := s.transform(e.Value, exp)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+// slice implements ${name[@]:offset:length} and ${@:offset:length}, which
+// select the elements from index offset on. A negative offset counts back
+// from the end, and an offset of 0 with $@ starts at $0.
+func (s *Shell) slice(exp *ParamExp, elems []element) ([]element, error) {
+	offset, err := s.expandInt(exp.Arg)
+	if err != nil {
+		return nil, err
+	}
+
+	end := 0
+	if len(elems) > 0 {
+		end = elems[len(elems)-1].Index + 1
+	}
+	if offset < 0 {
+		offset += end
+		if offset < 0 {
+			return nil, nil
+		}
+	}
+
+	if offset == 0 && exp.Index == nil {
+		elems = append([]element{{Key: "0", Value: os.Args[0]}}, elems...)
+	}
+
+	start := sort.Search(len(elems), func(i int) bool { return elems[i].Index >= offset })
+	elems = elems[start:]
+
+	if exp.Repl != nil {
+		length, err := s.expandInt(exp.Repl)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, fmt.Errorf("%d: substring expression < 0", length)
+		}
+		if length < len(elems) {
+			elems = elems[:length]
+		}
+	}
+	return elems, nil
+}
+
+// writeExpansion writes the result of a parameter expansion or command
+// substitution, which is split into fields only when unquoted.
+func (s *Shell) writeExpansion(x *expansion, value string, quoted, split bool) {
+	if split && !quoted {
+		x.writeSplit(value, s.ifs())
+		return
+	}
+	x.write(value, quoted)
+}
+
+// commandSubst runs list in a subshell with stdout connected to a pipe and
+// returns what it wrote, minus trailing newlines.
+func (s *Shell) commandSubst(list *List) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		r.Close()
+		close(done)
+	}()
+
+	sub := s.subshell()
+	sub.stdout = w
+	s.lastExitCode = sub.runAsSubshell(context.Background(), list)
+
+	w.Close()
+	<-done
+
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// paramValue returns the value of the parameter exp refers to as a single
+// string, and whether it is set.
+func (s *Shell) paramValue(exp *ParamExp) (string, bool, error) {
+	if listSubscript(exp) != "" {
+		elems := s.listElements(exp)
+		values := make([]string, len(elems))
+		for i, e := range elems {
+			values[i] = e.Value
+		}
+		return strings.Join(values, " "), len(values) > 0, nil
+	}
+
+	if exp.Index == nil {
+		value, set := s.lookupParam(exp.Name)
+		return value, set, nil
+	}
+
+	sub, err := s.expandWord(exp.Index)
+	if err != nil {
+		return "", false, err
+	}
+	return s.lookupElem(exp.Name, sub)
+}
+
+func (s *Shell) expandParam(exp *ParamExp) (string, error) {
+	if exp.Length && listSubscript(exp) != "" {
+		return strconv.Itoa(len(s.listElements(exp))), nil
+	}
+
+	value, set, err := s.paramValue(exp)
+	if err != nil {
+		return "", err
+	}
+	if exp.Length {
+		return strconv.Itoa(utf8.RuneCountInString(value)), nil
+	}
+
+	switch exp.Op {
+	case "":
+		return value, nil
+
+	case ":-", "-", ":=", "=", ":?", "?", ":+", "+":
+		null := !set || (exp.Op[0] == ':' && value == "")
+
+		switch strings.TrimPrefix(exp.Op, ":") {
+		case "-":
+			if null {
+				return s.expandWord(exp.Arg)
+			}
+		case "=":
+			if null {
+				if !isName(exp.Name) || listSubscript(exp) != "" {
+					return "", fmt.Errorf("$%s: cannot assign in this way", exp.Name)
+				}
+				word, err := s.expandWord(exp.Arg)
+				if err != nil {
+					return "", err
+				}
+				if exp.Index != nil {
+					sub, err := s.expandWord(exp.Index)
+					if err != nil {
+						return "", err
+					}
+					return word, s.setElem(exp.Name, sub, word, false)
+				}
+				return word, s.setVar(exp.Name, word)
+			}
+		case "?":
+			if null {
+				msg, err := s.expandWord(exp.Arg)
+				if err != nil {
+					return "", err
+				}
+				if msg == "" {
+					msg = "parameter null or not set"
+				}
+				return "", fmt.Errorf("%s: %s", exp.Name, msg)
+			}
+		case "+":
+			if null {
+				return "", nil
+			}
+			return s.expandWord(exp.Arg)
+		}
+		return value, nil
+
+	case ":":
+		return s.substring(value, exp)
+	}
+
+	return s.transform(value, exp)
+}
+
+// transform applies the pattern and case operators of exp to value.
+func (s *Shell) transform(value string, exp *ParamExp) (string, error) {
+	switch exp.Op {
+	case "#", "##", "%", "%%":
+		pattern, err := s.expandPattern(exp.Arg)
+		if err != nil {
+			return "", err
+		}
+		return removePattern(value, pattern, exp.Op), nil
+
+	case "/", "//", "/#", "/%":
+		pattern, err := s.expandPattern(exp.Arg)
+		if err != nil {
+			return "", err
+		}
+		repl := ""
+		if exp.Repl != nil {
+			if repl, err = s.expandWord(exp.Repl); err != nil {
+				return "", err
+			}
+		}
+		return replacePattern(value, pattern, repl, exp.Op), nil
+
+	case "^^", "^", ",,", ",":
+		pattern, err := s.expandPattern(exp.Arg)
+		if err != nil {
+			return "", err
+		}
+		return modifyCase(value, pattern, exp.Op), nil
+	}
+
+	return "", fmt.Errorf("${%s%s}: bad substitution", exp.Name, exp.Op)
+}
+
+// expandPattern expands a word used as a pattern. Quoted parts of the word
+// match literally.
+func (s *Shell) expandPattern(word *Word) (*glob.Pattern, error) {
+	x, err := s.expand(word, false)
+	if err != nil {
+		return nil, err
+	}
+	return glob.Compile(x.patterns[0]), nil
+}
+
+// runeBoundaries returns the byte offset of every rune in s followed by
+// len(s), so patterns are only tried on whole characters.
+func runeBoundaries(s string) []int {
+	bounds := make([]int, 0, len(s)+1)
+	for i := range s {
+		bounds = append(bounds, i)
+	}
+	return append(bounds, len(s))
+}
+
+func removePattern(value string, pattern *glob.Pattern, op string) string {
+	bounds := runeBoundaries(value)
+	n := len(bounds)
+
+	for k := 0; k < n; k++ {
+		switch op {
+		case "#":
+			if i := bounds[k]; pattern.Match(value[:i]) {
+				return value[i:]
+			}
+		case "##":
+			if i := bounds[n-1-k]; pattern.Match(value[:i]) {
+				return value[i:]
+			}
+		case "%":
+			if i := bounds[n-1-k]; pattern.Match(value[i:]) {
+				return value[:i]
+			}
+		case "%%":
+			if i := bounds[k]; pattern.Match(value[i:]) {
+				return value[:i]
+			}
+		}
+	}
+
+	return value
+}
+
+// replacePattern implements ${name/pat/rep} and its //, /# and /% forms,
+// always replacing the longest match at the earliest position.
+func replacePattern(value string, pattern *glob.Pattern, repl, op string) string {
+	bounds := runeBoundaries(value)
+	var sb strings.Builder
+	last := 0
+
+	for k := 0; k < len(bounds); k++ {
+		i := bounds[k]
+		if i < last || (op == "/#" && i > 0) {
+			continue
+		}
+
+		for l := len(bounds) - 1; l >= k; l-- {
+			j := bounds[l]
+			if op == "/%" && j != len(value) {
+				break
+			}
+			if j == i && op != "/#" && op != "/%" {
+				break
+			}
+			if !pattern.Match(value[i:j]) {
+				continue
+			}
+
+			sb.WriteString(value[last:i])
+			sb.WriteString(repl)
+			last = j
+			if op != "//" {
+				sb.WriteString(value[last:])
+				return sb.String()
+			}
+			break
+		}
+	}
+
+	sb.WriteString(value[last:])
+	return sb.String()
+}
+
+func (s *Shell) substring(value string, exp *ParamExp) (string, error) {
+	runes := []rune(value)
+
+	offset, err := s.expandInt(exp.Arg)
+	if err != nil {
+		return "", err
+	}
+	if offset < 0 {
+		offset += len(runes)
+	}
+	if offset < 0 || offset > len(runes) {
+		return "", nil
+	}
+
+	end := len(runes)
+	if exp.Repl != nil {
+		length, err := s.expandInt(exp.Repl)
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			end += length
+			if end < offset {
+				return "", fmt.Errorf("%d: substring expression < 0", length)
+			}
+		} else if offset+length < end {
+			end = offset + length
+		}
+	}
+
+	return string(runes[offset:end]), nil
+}
+
+// expandInt expands word and evaluates it as an arithmetic expression, for
+// the offset and length of ${name:offset:length}. An empty word is 0.
+func (s *Shell) expandInt(word *Word) (int, error) {
+	text, err := s.expandWord(word)
+	if err != nil {
+		return 0, err
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return 0, nil
+	}
+
+	n, err := s.arith(text)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// modifyCase implements ^^, ^, ,, and , which change the case of every
+// character, or only the first, that matches pattern.
+func modifyCase(value string, pattern *glob.Pattern, op string) string {
+	all := op == "^^" || op == ",,"
+	convert := unicode.ToUpper
+	if op[0] == ',' {
+		convert = unicode.ToLower
+	}
+
+	runes := []rune(value)
+	for i, r := range runes {
+		if pattern.Match("") || pattern.Match(string(r)) {
+			runes[i] = convert(r)
+		}
+		if !all {
+			break
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,50 @@
+package shell
+
+import "testing"
+
+func TestExpandParameters(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "default", script: "e=; echo ${u-a} ${u:-b} ${e-c}. ${e:-d}", want: "a b . d\n"},
+		{name: "assign default", script: "echo ${u:=x} $u", want: "x x\n"},
+		{name: "alternative", script: "x=1; echo ${x+set} ${u+set}.", want: "set .\n"},
+		{name: "length", script: "x=héllo; echo ${#x}", want: "5\n"},
+		{name: "prefix and suffix", script: "p=a/b/c.txt; echo ${p#*/} ${p##*/} ${p%.*} ${p%%/*}", want: "b/c.txt c.txt a/b/c a\n"},
+		{name: "replace", script: "x=aXbXc; echo ${x/X/-} ${x//X/-}", want: "a-bXc a-b-c\n"},
+		{name: "case", script: "x=abc; echo ${x^} ${x^^}", want: "Abc ABC\n"},
+		{name: "unset var error", script: "echo ${u?missing}", want: "Error: u: missing\n", status: 1},
+	})
+}
+
+func TestExpandSubstring(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "literal", script: "x=abcdef; echo ${x:2} ${x:2:3}", want: "cdef cde\n"},
+		{name: "negative offset", script: "x=abcdef; echo ${x: -2} ${x:(-3):2}", want: "ef de\n"},
+		{name: "negative length", script: "x=abcdef; echo ${x:1:-2}", want: "bcd\n"},
+		{name: "array slice", script: "a=(a b c d); echo ${a[@]:1:2}", want: "b c\n"},
+		{name: "positional slice", script: "set -- a b c; echo ${@:2}", want: "b c\n"},
+		{name: "missing offset", script: "x=abc; echo ${x:}", want: "", err: "bad substitution"},
+		{name: "length below zero", script: "x=abc; echo ${x:2:-2}", want: "Error: -2: substring expression < 0\n", status: 1},
+	})
+}
+
+func TestExpandBraces(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "list", script: "echo a{b,c}d", want: "abd acd\n"},
+		{name: "nested", script: "echo {a,b{1,2}}", want: "a b1 b2\n"},
+		{name: "sequence", script: "echo {1..3} {c..a}", want: "1 2 3 c b a\n"},
+		{name: "padded step", script: "echo {01..07..3}", want: "01 04 07\n"},
+		{name: "quoted", script: "echo '{a,b}' {a}", want: "{a,b} {a}\n"},
+	})
+}
+
+func TestExpandTilde(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "word", script: "HOME=/h; echo ~ ~/a x~", want: "/h /h/a x~\n"},
+		{name: "quoted", script: `HOME=/h; echo "~" '~'/a \~`, want: "~ ~/a ~\n"},
+		{name: "assignment", script: "HOME=/h; x=~/a; echo $x", want: "/h/a\n"},
+		{name: "braces", script: "HOME=/h; echo ~/{a,b}", want: "/h/a /h/b\n"},
+		{name: "here-string", script: "HOME=/h; cat <<< ~/a", want: "/h/a\n"},
+		{name: "here-document", script: "HOME=/h; x=1; cat <<EOF\n~/a $x\nEOF", want: "~/a 1\n"},
+		{name: "quoted here-document", script: "cat <<'EOF'\n~/a $x\nEOF", want: "~/a $x\n"},
+	})
+}
@@ -0,0 +1,507 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lexer splits input into operator and word tokens. Word tokens keep their
+// source text, quotes included; Parser turns them into word parts.
+type lexer struct {
+	input    string
+	tokens   []Token
+	heredocs []pendingHeredoc
+}
+
+type pendingHeredoc struct {
+	token int
+	delim string
+	strip bool
+}
+
+func (p *Parser) tokenize(input string) ([]Token, error) {
+	lx := &lexer{input: input}
+	if err := lx.run(); err != nil {
+		return nil, err
+	}
+	return lx.tokens, nil
+}
+
+func (lx *lexer) emit(tokenType TokenType, value string, pos int) {
+	lx.tokens = append(lx.tokens, Token{Type: tokenType, Value: value, Pos: pos, End: pos + len(value)})
+}
+
+func (lx *lexer) run() error {
+	input := lx.input
+
+	for pos := 0; pos < len(input); pos++ {
+		char := input[pos]
+
+		switch {
+		case char == ' ' || char == '\t':
+
+		case char == '\\' && pos+1 < len(input) && input[pos+1] == '\n':
+			if pos+2 == len(input) {
+				return &ParseError{Message: "unexpected end of input", Pos: len(input), Incomplete: true}
+			}
+			pos++
+
+		case char == '\n':
+			lx.emit(TokenNewline, "\n", pos)
+
+			if len(lx.heredocs) > 0 {
+				next, err := lx.readHeredocBodies(pos + 1)
+				if err != nil {
+					return err
+				}
+				pos = next - 1
+			}
+
+		case char == '#':
+			for pos+1 < len(input) && input[pos+1] != '\n' {
+				pos++
+			}
+
+		case char == '|':
+			if strings.HasPrefix(input[pos:], "||") {
+				lx.emit(TokenOr, "||", pos)
+				pos++
+			} else {
+				lx.emit(TokenPipe, "|", pos)
+			}
+
+		case (char == '>' || char == '<') && !isProcSubst(input, pos):
+			next, err := lx.redirect("", pos, pos)
+			if err != nil {
+				return err
+			}
+			pos = next - 1
+
+		case char == '&':
+			switch {
+			case strings.HasPrefix(input[pos:], "&>>"):
+				lx.emit(TokenRedirectAllAppend, "&>>", pos)
+				pos += 2
+			case strings.HasPrefix(input[pos:], "&>"):
+				lx.emit(TokenRedirectAll, "&>", pos)
+				pos++
+			case strings.HasPrefix(input[pos:], "&&"):
+				lx.emit(TokenAnd, "&&", pos)
+				pos++
+			default:
+				lx.emit(TokenBackground, "&", pos)
+			}
+
+		case char == ';':
+			switch {
+			case strings.HasPrefix(input[pos:], ";;&"):
+				lx.emit(TokenDoubleSemicolonAnd, ";;&", pos)
+				pos += 2
+			case strings.HasPrefix(input[pos:], ";;"):
+				lx.emit(TokenDoubleSemicolon, ";;", pos)
+				pos++
+			case strings.HasPrefix(input[pos:], ";&"):
+				lx.emit(TokenSemicolonAnd, ";&", pos)
+				pos++
+			default:
+				lx.emit(TokenSemicolon, ";", pos)
+			}
+
+		case strings.HasPrefix(input[pos:], "((") && isArithCommand(input, pos):
+			end, err := findClosingParen(input, pos+1)
+			if err != nil {
+				return err
+			}
+			lx.emit(TokenArith, input[pos+2:end-1], pos)
+			lx.tokens[len(lx.tokens)-1].End = end + 1
+			pos = end
+
+		case char == '(':
+			lx.emit(TokenLeftParen, "(", pos)
+
+		case char == ')':
+			lx.emit(TokenRightParen, ")", pos)
+
+		default:
+			end, err := scanWord(input, pos)
+			if err != nil {
+				return err
+			}
+
+			word := input[pos:end]
+
+			// A run of digits directly before a redirection operator names
+			// the file descriptor being redirected, as in 2>err.log.
+			if end < len(input) && (input[end] == '<' || input[end] == '>') && isDigits(word) {
+				if end, err = lx.redirect(word, pos, end); err != nil {
+					return err
+				}
+			} else {
+				lx.emit(TokenWord, word, pos)
+			}
+			pos = end - 1
+		}
+	}
+
+	if len(lx.heredocs) > 0 {
+		return &ParseError{Message: "unterminated here-document", Pos: len(input), Incomplete: true}
+	}
+
+	return nil
+}
+
+// redirect emits the redirection operator at pos, prefixed by an optional
+// fd number that started at start, and returns the position after it. For
+// here-documents the delimiter is read as well.
+func (lx *lexer) redirect(fd string, start, pos int) (int, error) {
+	op, tokenType := redirectOperator(lx.input[pos:])
+	lx.emit(tokenType, fd+op, start)
+	pos += len(op)
+
+	if tokenType != TokenHeredoc {
+		return pos, nil
+	}
+
+	delim, quoted, n := readHeredocDelimiter(lx.input[pos:])
+	if delim == "" {
+		return 0, &ParseError{Message: "missing here-document delimiter", Pos: pos}
+	}
+
+	lx.heredocs = append(lx.heredocs, pendingHeredoc{
+		token: len(lx.tokens),
+		delim: delim,
+		strip: op == "<<-",
+	})
+	lx.tokens = append(lx.tokens, Token{Type: TokenWord, Pos: pos, End: pos + n, Quoted: quoted})
+
+	return pos + n, nil
+}
+
+// isArithCommand reports whether the "((" at pos closes with "))". If not,
+// it opens two nested subshells instead.
+func isArithCommand(input string, pos int) bool {
+	end, err := findClosingParen(input, pos+1)
+	if err != nil {
+		// Read more input rather than guess.
+		return isIncomplete(err)
+	}
+	return input[end-1] == ')'
+}
+
+// isProcSubst reports whether a process substitution, <(...) or >(...),
+// starts at pos.
+func isProcSubst(input string, pos int) bool {
+	return pos+1 < len(input) && (input[pos] == '<' || input[pos] == '>') && input[pos+1] == '('
+}
+
+func isMetachar(c byte) bool {
+	return strings.IndexByte(" \t\n;&|<>()", c) >= 0
+}
+
+// scanWord returns the end of the word starting at start. Quoted text and
+// expansions may contain metacharacters without ending the word.
+func scanWord(input string, start int) (int, error) {
+	pos := start
+
+	if isProcSubst(input, pos) {
+		end, err := findClosingParen(input, pos+2)
+		if err != nil {
+			return 0, err
+		}
+		pos = end + 1
+	}
+
+	for pos < len(input) && !isMetachar(input[pos]) {
+		var err error
+
+		switch input[pos] {
+		case '\\':
+			pos++
+		case '\'':
+			end := strings.IndexByte(input[pos+1:], '\'')
+			if end < 0 {
+				return 0, &ParseError{Message: "unclosed quote", Pos: len(input), Incomplete: true}
+			}
+			pos += end + 1
+		case '"':
+			pos, err = findClosingDoubleQuote(input, pos+1)
+		case '`':
+			pos, err = findClosingBackquote(input, pos+1)
+		case '$':
+			if pos+1 < len(input) && input[pos+1] == '(' {
+				pos, err = findClosingParen(input, pos+2)
+			} else if pos+1 < len(input) && input[pos+1] == '{' {
+				pos, err = findClosingBrace(input, pos+2)
+			}
+		case '?', '*', '+', '@', '!':
+			// An extglob group may contain '|' and blanks.
+			if pos+1 < len(input) && input[pos+1] == '(' {
+				pos, err = findClosingParen(input, pos+2)
+			}
+		case '=':
+			// So may the elements of an array assignment, name=(...).
+			if pos+1 < len(input) && input[pos+1] == '(' && isName(strings.TrimSuffix(input[start:pos], "+")) {
+				pos, err = findClosingParen(input, pos+2)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		pos++
+	}
+
+	if pos > len(input) {
+		pos = len(input)
+	}
+	return pos, nil
+}
+
+func findClosingDoubleQuote(input string, start int) (int, error) {
+	for pos := start; pos < len(input); pos++ {
+		var err error
+
+		switch input[pos] {
+		case '\\':
+			pos++
+		case '"':
+			return pos, nil
+		case '`':
+			pos, err = findClosingBackquote(input, pos+1)
+		case '$':
+			if pos+1 < len(input) && input[pos+1] == '(' {
+				pos, err = findClosingParen(input, pos+2)
+			} else if pos+1 < len(input) && input[pos+1] == '{' {
+				pos, err = findClosingBrace(input, pos+2)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, &ParseError{Message: "unclosed quote", Pos: len(input), Incomplete: true}
+}
+
+// findClosingParen returns the index of the ')' matching an opening
+// parenthesis just before start, skipping over quoted text and nested
+// substitutions.
+func findClosingParen(input string, start int) (int, error) {
+	depth := 1
+
+	for pos := start; pos < len(input); pos++ {
+		var err error
+
+		switch input[pos] {
+		case '\\':
+			pos++
+		case '\'':
+			end := strings.IndexByte(input[pos+1:], '\'')
+			if end < 0 {
+				return 0, &ParseError{Message: "unclosed quote", Pos: len(input), Incomplete: true}
+			}
+			pos += end + 1
+		case '"':
+			pos, err = findClosingDoubleQuote(input, pos+1)
+		case '`':
+			pos, err = findClosingBackquote(input, pos+1)
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pos, nil
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, &ParseError{Message: "unclosed command substitution", Pos: len(input), Incomplete: true}
+}
+
+// findClosingBrace returns the index of the '}' ending a ${...} expansion
+// whose body starts at start.
+func findClosingBrace(input string, start int) (int, error) {
+	depth := 1
+
+	for pos := start; pos < len(input); pos++ {
+		var err error
+
+		switch input[pos] {
+		case '\\':
+			pos++
+		case '\'':
+			end := strings.IndexByte(input[pos+1:], '\'')
+			if end < 0 {
+				return 0, &ParseError{Message: "unclosed quote", Pos: len(input), Incomplete: true}
+			}
+			pos += end + 1
+		case '"':
+			pos, err = findClosingDoubleQuote(input, pos+1)
+		case '$':
+			if pos+1 < len(input) && input[pos+1] == '(' {
+				pos, err = findClosingParen(input, pos+2)
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return pos, nil
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, &ParseError{Message: "unclosed parameter expansion", Pos: len(input), Incomplete: true}
+}
+
+func findClosingBackquote(input string, start int) (int, error) {
+	for pos := start; pos < len(input); pos++ {
+		switch input[pos] {
+		case '\\':
+			pos++
+		case '`':
+			return pos, nil
+		}
+	}
+
+	return 0, &ParseError{Message: "unclosed command substitution", Pos: len(input), Incomplete: true}
+}
+
+// unescapeBackquoted removes the backslashes that protect $, ` and \
+// inside a backquoted command substitution.
+func unescapeBackquoted(input string) string {
+	var sb strings.Builder
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\\' && i+1 < len(input) && strings.IndexByte("$`\\", input[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(input[i])
+	}
+	return sb.String()
+}
+
+// readHeredocDelimiter reads the word following << and reports whether any
+// part of it was quoted, which disables expansion of the body.
+func readHeredocDelimiter(input string) (string, bool, int) {
+	var delim strings.Builder
+	quoted := false
+	quoteChar := byte(0)
+
+	pos := 0
+	for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+		pos++
+	}
+
+	for ; pos < len(input); pos++ {
+		char := input[pos]
+		switch {
+		case quoteChar != 0:
+			if char == quoteChar {
+				quoteChar = 0
+			} else {
+				delim.WriteByte(char)
+			}
+		case char == '"' || char == '\'':
+			quoted = true
+			quoteChar = char
+		case char == '\\' && pos+1 < len(input):
+			quoted = true
+			pos++
+			delim.WriteByte(input[pos])
+		case isMetachar(char):
+			return delim.String(), quoted, pos
+		default:
+			delim.WriteByte(char)
+		}
+	}
+
+	return delim.String(), quoted, pos
+}
+
+// readHeredocBodies consumes the bodies of the pending here-documents from
+// the line starting at start, stores them in their body tokens and returns
+// the position after the last delimiter line.
+func (lx *lexer) readHeredocBodies(start int) (int, error) {
+	input := lx.input
+	pos := start
+
+	for _, h := range lx.heredocs {
+		var body strings.Builder
+
+		for {
+			if pos >= len(input) {
+				return 0, &ParseError{
+					Message:    fmt.Sprintf("here-document delimited by '%s' is not terminated", h.delim),
+					Pos:        len(input),
+					Incomplete: true,
+				}
+			}
+
+			end := strings.IndexByte(input[pos:], '\n')
+			var line string
+			if end < 0 {
+				line = input[pos:]
+				pos = len(input)
+			} else {
+				line = input[pos : pos+end]
+				pos += end + 1
+			}
+
+			if h.strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == h.delim {
+				break
+			}
+
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+
+		lx.tokens[h.token].Value = body.String()
+		lx.tokens[h.token].End = len(strings.TrimSuffix(input[:pos], "\n"))
+	}
+
+	lx.heredocs = nil
+	return pos, nil
+}
+
+var redirectOperators = []struct {
+	op        string
+	tokenType TokenType
+}{
+	{"<<<", TokenHereString},
+	{"<<-", TokenHeredoc},
+	{"<<", TokenHeredoc},
+	{">>", TokenRedirectAppend},
+	{">&", TokenRedirectDupOut},
+	{">|", TokenRedirectOut},
+	{">", TokenRedirectOut},
+	{"<>", TokenRedirectReadWrite},
+	{"<&", TokenRedirectDupIn},
+	{"<", TokenRedirectIn},
+}
+
+func redirectOperator(input string) (string, TokenType) {
+	for _, r := range redirectOperators {
+		if strings.HasPrefix(input, r.op) {
+			return r.op, r.tokenType
+		}
+	}
+	return input[:1], TokenRedirectOut
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,18 +1,24 @@
 package shell
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strconv"
 	"strings"
 )
 
 type Parser struct {
-    shell *Shell
+	shell *Shell
 }
 
+// Token is a lexer token. Pos and End are the offsets of its source text
+// in the input, which for (( )) and here-document bodies is not Value.
 type Token struct {
-    Type  TokenType
-    Value string
+	Type   TokenType
+	Value  string
+	Pos    int
+	End    int
+	Quoted bool
 }
 
 type TokenType int
@@ -27,226 +33,1237 @@ const (
 	TokenAnd
 	TokenOr
 	TokenSemicolon
-	TokenQuote
-	TokenVariable
+	TokenRedirectReadWrite
+	TokenRedirectDupIn
+	TokenRedirectDupOut
+	TokenRedirectAll
+	TokenRedirectAllAppend
+	TokenHeredoc
+	TokenHereString
+	TokenNewline
+	TokenArith
+	TokenLeftParen
+	TokenRightParen
+	TokenDoubleSemicolon
+	TokenSemicolonAnd
+	TokenDoubleSemicolonAnd
 )
 
+// ParseError reports malformed input. Incomplete is set when the input
+// ended before a construct was closed and more lines could complete it.
 type ParseError struct {
-	Message string
-	Pos     int
-}
-
-type Command struct {
-	Args         []string
-	Stdin        string
-	Stdout       string
-	StdoutAppend bool
-	Background   bool
-	Env          []string
-	Dir          string
+	Message    string
+	Pos        int
+	Incomplete bool
 }
 
 func (e *ParseError) Error() string {
 	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Message)
 }
 
+func isIncomplete(err error) bool {
+	var parseErr *ParseError
+	return errors.As(err, &parseErr) && parseErr.Incomplete
+}
+
 func NewParser(shell *Shell) *Parser {
 	return &Parser{shell: shell}
 }
 
-func (p *Parser) Parse(input string) ([]Command, error) {
+func (p *Parser) Parse(input string) (*List, error) {
 	tokens, err := p.tokenize(input)
 	if err != nil {
+		return nil, err
+	}
+
+	return p.parseTokens(tokens, input)
+}
+
+func extractVariableName(input string) string {
+	var name strings.Builder
+	for i, c := range input {
+		if i == 0 && !isAlpha(c) && c != '_' {
+			return ""
+		}
+
+		if !isAlphaNumeric(c) && c != '_' {
+			break
+		}
+
+		name.WriteRune(c)
+	}
+
+	return name.String()
+}
+
+func isAlpha(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlphaNumeric(c rune) bool {
+	return isAlpha(c) || (c >= '0' && c <= '9')
+}
+
+// parseState holds the cursor for a single Parse call so that a Parser can
+// be shared by nested and concurrent evaluations.
+type parseState struct {
+	parser *Parser
+	tokens []Token
+	pos    int
+	input  string
+}
+
+func (p *Parser) parseTokens(tokens []Token, input string) (*List, error) {
+	ps := &parseState{parser: p, tokens: tokens, input: input}
+
+	list, err := ps.parseList()
+	if err != nil {
+		return nil, err
+	}
+
+	// parseList stops early only at a reserved word closing a compound
+	// command that was never opened.
+	if ps.pos < len(ps.tokens) {
+		return nil, ps.unexpected()
+	}
+	return list, nil
+}
+
+func (ps *parseState) peek() (Token, bool) {
+	if ps.pos >= len(ps.tokens) {
+		return Token{}, false
+	}
+	return ps.tokens[ps.pos], true
+}
+
+func (ps *parseState) skipNewlines() {
+	for ps.pos < len(ps.tokens) && ps.tokens[ps.pos].Type == TokenNewline {
+		ps.pos++
+	}
+}
+
+func (ps *parseState) unexpected() error {
+	tok, ok := ps.peek()
+	if !ok {
+		return &ParseError{Message: "unexpected end of input", Pos: len(ps.input), Incomplete: true}
+	}
+	if tok.Type == TokenNewline {
+		return &ParseError{Message: "unexpected newline", Pos: tok.Pos}
+	}
+	return &ParseError{Message: fmt.Sprintf("unexpected token '%s'", tok.Value), Pos: tok.Pos}
+}
+
+// reservedWords are recognised only where a command could start and only
+// when unquoted. closingWords end the list inside a compound command.
+var (
+	reservedWords = map[string]bool{
+		"if": true, "then": true, "elif": true, "else": true, "fi": true,
+		"for": true, "while": true, "until": true, "do": true, "done": true,
+		"case": true, "esac": true, "function": true, "{": true, "}": true,
+		"!": true,
+	}
+	closingWords = map[string]bool{
+		"then": true, "elif": true, "else": true, "fi": true,
+		"do": true, "done": true, "esac": true, "}": true,
+	}
+)
+
+// reserved returns the reserved word at the cursor, or "".
+func (ps *parseState) reserved() string {
+	tok, ok := ps.peek()
+	if ok && tok.Type == TokenWord && reservedWords[tok.Value] {
+		return tok.Value
+	}
+	return ""
+}
+
+func (ps *parseState) expect(word string) error {
+	if ps.reserved() != word {
+		return ps.unexpected()
+	}
+	ps.pos++
+	return nil
+}
+
+func isCaseTerminator(tok Token) bool {
+	switch tok.Type {
+	case TokenDoubleSemicolon, TokenSemicolonAnd, TokenDoubleSemicolonAnd:
+		return true
+	}
+	return false
+}
+
+func (ps *parseState) parseList() (*List, error) {
+	list := &List{}
+
+	for {
+		ps.skipNewlines()
+		tok, ok := ps.peek()
+		if !ok || isCaseTerminator(tok) || tok.Type == TokenRightParen || closingWords[ps.reserved()] {
+			break
+		}
+
+		item, err := ps.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, item)
+
+		tok, ok = ps.peek()
+		if !ok {
+			break
+		}
+
+		switch tok.Type {
+		case TokenSemicolon, TokenNewline:
+			ps.pos++
+		case TokenBackground:
+			item.Background = true
+			ps.pos++
+		default:
+			if isCaseTerminator(tok) || tok.Type == TokenRightParen {
+				return list, nil
+			}
+			return nil, ps.unexpected()
+		}
+	}
+
+	return list, nil
+}
+
+func (ps *parseState) parseAndOr() (*AndOr, error) {
+	first := ps.pos
+	pipeline, err := ps.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	andOr := &AndOr{Pipelines: []*Pipeline{pipeline}}
+
+	for {
+		tok, ok := ps.peek()
+		if !ok || (tok.Type != TokenAnd && tok.Type != TokenOr) {
+			andOr.Source = ps.source(first)
+			return andOr, nil
+		}
+		ps.pos++
+		ps.skipNewlines()
+
+		pipeline, err := ps.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Ops = append(andOr.Ops, tok.Type)
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+	}
+}
+
+func (ps *parseState) parsePipeline() (*Pipeline, error) {
+	pipeline := &Pipeline{}
+
+	for ps.reserved() == "!" {
+		pipeline.Negated = !pipeline.Negated
+		ps.pos++
+	}
+
+	for {
+		cmd, err := ps.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+
+		tok, ok := ps.peek()
+		if cmd == nil {
+			if ok && tok.Type == TokenPipe {
+				return nil, &ParseError{Message: "empty command before pipe", Pos: tok.Pos}
+			}
+			return nil, ps.unexpected()
+		}
+		pipeline.Commands = append(pipeline.Commands, cmd)
+
+		if !ok || tok.Type != TokenPipe {
+			return pipeline, nil
+		}
+		ps.pos++
+		ps.skipNewlines()
+	}
+}
+
+// parseCommand returns nil when no command starts at the cursor.
+func (ps *parseState) parseCommand() (Node, error) {
+	node, err := ps.parseCompound()
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		if ps.reserved() != "" {
+			return nil, nil
+		}
+		cmd, err := ps.parseSimpleCommand()
+		if cmd == nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+
+	if _, ok := node.(*FuncDecl); ok {
+		return node, nil
+	}
+
+	var redirects []*Redirect
+	for {
+		tok, ok := ps.peek()
+		if !ok || !isRedirectToken(tok) {
+			break
+		}
+		r, err := ps.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, r)
+		ps.pos++
+	}
+
+	if len(redirects) > 0 {
+		return &Redirected{Command: node, Redirects: redirects}, nil
+	}
+	return node, nil
+}
+
+// parseCompound parses the compound command or function definition at the
+// cursor, if there is one.
+func (ps *parseState) parseCompound() (Node, error) {
+	if tok, ok := ps.peek(); ok && tok.Type == TokenLeftParen {
+		return ps.parseSubshell()
+	}
+	if tok, ok := ps.peek(); ok && tok.Type == TokenArith {
+		ps.pos++
+		expr, err := ps.arithWord(tok.Value, tok.Pos)
+		if err != nil {
+			return nil, err
+		}
+		return &ArithCommand{Expr: expr}, nil
+	}
+
+	switch word := ps.reserved(); {
+	case word == "if":
+		return ps.parseIf()
+	case word == "for":
+		return ps.parseFor()
+	case word == "while" || word == "until":
+		return ps.parseWhile()
+	case word == "case":
+		return ps.parseCase()
+	case word == "{":
+		return ps.parseBlock()
+	case word == "function":
+		return ps.parseFunction(true)
+	case word == "" && ps.atFunction():
+		return ps.parseFunction(false)
+	}
+	return nil, nil
+}
+
+func (ps *parseState) parseSubshell() (*Subshell, error) {
+	ps.pos++
+
+	list, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := ps.peek(); !ok || tok.Type != TokenRightParen {
+		return nil, ps.unexpected()
+	}
+	ps.pos++
+	return &Subshell{List: list}, nil
+}
+
+// parseCompoundList parses the non-empty list inside a compound command.
+func (ps *parseState) parseCompoundList() (*List, error) {
+	list, err := ps.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, ps.unexpected()
+	}
+	return list, nil
+}
+
+// parseIf parses an if or elif clause up to and including the closing fi.
+// An elif becomes a nested IfClause in Else, which consumes the fi.
+func (ps *parseState) parseIf() (*IfClause, error) {
+	ps.pos++
+
+	cond, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.expect("then"); err != nil {
+		return nil, err
+	}
+	body, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+
+	clause := &IfClause{Cond: cond, Then: body}
+
+	switch ps.reserved() {
+	case "elif":
+		elif, err := ps.parseIf()
+		if err != nil {
+			return nil, err
+		}
+		clause.Else = elif
+		return clause, nil
+
+	case "else":
+		ps.pos++
+		body, err := ps.parseCompoundList()
+		if err != nil {
+			return nil, err
+		}
+		clause.Else = body
+	}
+
+	if err := ps.expect("fi"); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseFor parses both the word list and the arithmetic form of for.
+func (ps *parseState) parseFor() (Node, error) {
+	ps.pos++
+
+	tok, ok := ps.peek()
+	if ok && tok.Type == TokenArith {
+		ps.pos++
+		parts := strings.Split(tok.Value, ";")
+		if len(parts) != 3 {
+			return nil, &ParseError{Message: "expected 'for ((init; cond; post))'", Pos: tok.Pos}
+		}
+		exprs := make([]*Word, len(parts))
+		for i, part := range parts {
+			var err error
+			if exprs[i], err = ps.arithWord(part, tok.Pos); err != nil {
+				return nil, err
+			}
+		}
+
+		if tok, ok := ps.peek(); ok && tok.Type == TokenSemicolon {
+			ps.pos++
+		}
+		body, err := ps.parseDoGroup()
+		if err != nil {
+			return nil, err
+		}
+		return &ArithForClause{Init: exprs[0], Cond: exprs[1], Post: exprs[2], Body: body}, nil
+	}
+
+	if !ok || tok.Type != TokenWord || !isName(tok.Value) {
+		return nil, ps.unexpected()
+	}
+	ps.pos++
+	clause := &ForClause{Name: tok.Value}
+
+	ps.skipNewlines()
+	if tok, ok := ps.peek(); ok && tok.Type == TokenWord && tok.Value == "in" {
+		ps.pos++
+		clause.In = true
+
+		for {
+			tok, ok := ps.peek()
+			if !ok || tok.Type != TokenWord {
+				break
+			}
+			word, err := ps.word(tok)
+			if err != nil {
+				return nil, err
+			}
+			clause.Words = append(clause.Words, word)
+			ps.pos++
+		}
+
+		tok, ok := ps.peek()
+		if !ok || (tok.Type != TokenSemicolon && tok.Type != TokenNewline) {
+			return nil, ps.unexpected()
+		}
+		ps.pos++
+	} else if ok && tok.Type == TokenSemicolon {
+		ps.pos++
+	}
+
+	body, err := ps.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+	clause.Body = body
+	return clause, nil
+}
+
+func (ps *parseState) parseWhile() (*WhileClause, error) {
+	clause := &WhileClause{Until: ps.reserved() == "until"}
+	ps.pos++
+
+	cond, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ps.parseDoGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	clause.Cond = cond
+	clause.Body = body
+	return clause, nil
+}
+
+// parseDoGroup parses "do list done", allowing newlines before do.
+func (ps *parseState) parseDoGroup() (*List, error) {
+	ps.skipNewlines()
+	if err := ps.expect("do"); err != nil {
+		return nil, err
+	}
+	body, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.expect("done"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (ps *parseState) parseBlock() (*Block, error) {
+	ps.pos++
+
+	list, err := ps.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.expect("}"); err != nil {
+		return nil, err
+	}
+	return &Block{List: list}, nil
+}
+
+// atFunction reports whether the cursor is at "name()".
+func (ps *parseState) atFunction() bool {
+	if ps.pos+2 >= len(ps.tokens) {
+		return false
+	}
+	name, open, close := ps.tokens[ps.pos], ps.tokens[ps.pos+1], ps.tokens[ps.pos+2]
+	return name.Type == TokenWord && open.Type == TokenLeftParen && close.Type == TokenRightParen
+}
+
+// parseFunction parses "name() body" or, after the function keyword,
+// "function name [()] body". The body must be a compound command.
+func (ps *parseState) parseFunction(keyword bool) (*FuncDecl, error) {
+	first := ps.pos
+	if keyword {
+		ps.pos++
+	}
+
+	tok, ok := ps.peek()
+	if !ok || tok.Type != TokenWord {
+		return nil, ps.unexpected()
+	}
+	if strings.ContainsAny(tok.Value, "$`'\"\\=") {
+		return nil, &ParseError{Message: fmt.Sprintf("'%s': not a valid function name", tok.Value), Pos: tok.Pos}
+	}
+	ps.pos++
+
+	if tok, ok := ps.peek(); ok && tok.Type == TokenLeftParen {
+		ps.pos++
+		if tok, ok := ps.peek(); !ok || tok.Type != TokenRightParen {
+			return nil, ps.unexpected()
+		}
+		ps.pos++
+	}
+
+	ps.skipNewlines()
+	body, err := ps.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	if _, simple := body.(*Command); body == nil || simple {
+		return nil, ps.unexpected()
+	}
+
+	return &FuncDecl{
+		Name:   tok.Value,
+		Body:   body,
+		Source: ps.source(first),
+	}, nil
+}
+
+// source returns the input text of the tokens from index first up to the
+// current one. A here-document body ends further on than the tokens that
+// follow its operator on the same line, so the text runs to the furthest
+// end of any of them.
+func (ps *parseState) source(first int) string {
+	start, end := ps.tokens[first].Pos, 0
+	for _, tok := range ps.tokens[first:ps.pos] {
+		end = max(end, tok.End)
+	}
+	return ps.input[start:end]
+}
+
+func (ps *parseState) parseCase() (*CaseClause, error) {
+	ps.pos++
+
+	tok, ok := ps.peek()
+	if !ok || tok.Type != TokenWord {
+		return nil, ps.unexpected()
+	}
+	word, err := ps.word(tok)
+	if err != nil {
+		return nil, err
+	}
+	ps.pos++
+
+	ps.skipNewlines()
+	if tok, ok := ps.peek(); !ok || tok.Type != TokenWord || tok.Value != "in" {
+		return nil, ps.unexpected()
+	}
+	ps.pos++
+
+	clause := &CaseClause{Word: word}
+	for {
+		ps.skipNewlines()
+		if ps.reserved() == "esac" {
+			ps.pos++
+			return clause, nil
+		}
+
+		item, err := ps.parseCaseItem()
+		if err != nil {
 			return nil, err
+		}
+		clause.Items = append(clause.Items, item)
+	}
+}
+
+// parseCaseItem parses "[(] pattern [| pattern]... ) list" and its
+// terminator, which may be omitted before esac.
+func (ps *parseState) parseCaseItem() (*CaseItem, error) {
+	if tok, ok := ps.peek(); ok && tok.Type == TokenLeftParen {
+		ps.pos++
+	}
+
+	item := &CaseItem{Op: TokenDoubleSemicolon}
+	for {
+		tok, ok := ps.peek()
+		if !ok || tok.Type != TokenWord {
+			return nil, ps.unexpected()
+		}
+		pattern, err := ps.word(tok)
+		if err != nil {
+			return nil, err
+		}
+		item.Patterns = append(item.Patterns, pattern)
+		ps.pos++
+
+		tok, ok = ps.peek()
+		if ok && tok.Type == TokenPipe {
+			ps.pos++
+			continue
+		}
+		if ok && tok.Type == TokenRightParen {
+			ps.pos++
+			break
+		}
+		return nil, ps.unexpected()
 	}
 
-	return p.parseTokens(tokens)
-}
-
-func (p *Parser) tokenize(input string) ([]Token, error) {
-	var tokens []Token
-	var current strings.Builder
-	inQuote := false
-	quoteChar := rune(0)
-
-	for pos, char := range input {
-			switch {
-			case char == '"' || char == '\'':
-					if !inQuote {
-							inQuote = true
-							quoteChar = char
-					} else if char == quoteChar {
-							inQuote = false
-							tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-							current.Reset()
-					} else {
-							current.WriteRune(char)
-					}
-
-			case char == '|' && !inQuote:
-					if current.Len() > 0 {
-							tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-							current.Reset()
-					}
-					
-					tokens = append(tokens, Token{Type: TokenPipe, Value: "|"})
-
-			case char == '>' && !inQuote:
-					if pos+1 < len(input) && input[pos+1] == '>' {
-							if current.Len() > 0 {
-									tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-									current.Reset()
-							}
-							tokens = append(tokens, Token{Type: TokenRedirectAppend, Value: ">>"})
-							pos++ // Skip next character
-					} else {
-							if current.Len() > 0 {
-									tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-									current.Reset()
-							}
-							tokens = append(tokens, Token{Type: TokenRedirectOut, Value: ">"})
-					}
-
-			case char == '<' && !inQuote:
-					if current.Len() > 0 {
-							tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-							current.Reset()
-					}
-					tokens = append(tokens, Token{Type: TokenRedirectIn, Value: "<"})
-
-			case char == '&' && !inQuote:
-					if pos+1 < len(input) && input[pos+1] == '&' {
-							if current.Len() > 0 {
-									tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-									current.Reset()
-							}
-							tokens = append(tokens, Token{Type: TokenAnd, Value: "&&"})
-							pos++ // Skip next character
-					}
-
-			case char == '$' && !inQuote:
-					if current.Len() > 0 {
-							tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-							current.Reset()
-					}
-					
-					varName := p.extractVariableName(input[pos+1:])
-					
-					if varName != "" {
-							tokens = append(tokens, Token{Type: TokenVariable, Value: varName})
-							pos += len(varName)
-					}
-
-			case char == ';' && !inQuote:
-					if current.Len() > 0 {
-						tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-						current.Reset()
-				}
-				
-				tokens = append(tokens, Token{Type: TokenSemicolon, Value: ";"})
-
-		case char == ' ' && !inQuote:
-				if current.Len() > 0 {
-						tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
-						current.Reset()
-				}
+	body, err := ps.parseList()
+	if err != nil {
+		return nil, err
+	}
+	item.Body = body
+
+	tok, ok := ps.peek()
+	switch {
+	case ok && isCaseTerminator(tok):
+		item.Op = tok.Type
+		ps.pos++
+	case ps.reserved() != "esac":
+		return nil, ps.unexpected()
+	}
+	return item, nil
+}
+
+// parseSimpleCommand returns nil when no word or redirection starts at the
+// cursor.
+func (ps *parseState) parseSimpleCommand() (*Command, error) {
+	cmd := &Command{}
+
+	for {
+		tok, ok := ps.peek()
+		if !ok {
+			break
+		}
+
+		switch tok.Type {
+		case TokenWord:
+			assign, err := ps.assignment(tok)
+			if err != nil {
+				return nil, err
+			}
+			if assign != nil && len(cmd.Words) == 0 {
+				cmd.Assigns = append(cmd.Assigns, assign)
+				break
+			}
+
+			// declare and the like parse array assignments themselves,
+			// once they know from their options what kind of array to
+			// create, so these reach them as they were written.
+			if assign != nil && assign.Array != nil && isDeclaration(cmd.Words[0]) {
+				cmd.Words = append(cmd.Words, &Word{Parts: []WordPart{&SglQuoted{Value: tok.Value}}})
+				break
+			}
+
+			word, err := ps.word(tok)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Words = append(cmd.Words, word)
 
 		default:
-				current.WriteRune(char)
+			if !isRedirectToken(tok) {
+				return commandOrNil(cmd), nil
+			}
+			r, err := ps.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirects = append(cmd.Redirects, r)
+		}
+
+		ps.pos++
+	}
+
+	return commandOrNil(cmd), nil
+}
+
+func isRedirectToken(tok Token) bool {
+	switch tok.Type {
+	case TokenRedirectIn, TokenRedirectOut, TokenRedirectAppend, TokenRedirectReadWrite,
+		TokenRedirectDupIn, TokenRedirectDupOut, TokenRedirectAll, TokenRedirectAllAppend,
+		TokenHeredoc, TokenHereString:
+		return true
+	}
+	return false
+}
+
+// parseRedirect parses the redirection at the cursor and leaves the cursor
+// on its target.
+func (ps *parseState) parseRedirect() (*Redirect, error) {
+	tok := ps.tokens[ps.pos]
+
+	if tok.Type == TokenHeredoc {
+		ps.pos++
+		body, err := ps.heredocWord(ps.tokens[ps.pos])
+		if err != nil {
+			return nil, err
+		}
+		return &Redirect{Op: tok.Type, Fd: redirectFd(tok), Target: body}, nil
+	}
+
+	if ps.pos+1 >= len(ps.tokens) || !isWordToken(ps.tokens[ps.pos+1]) {
+		switch tok.Type {
+		case TokenRedirectIn, TokenRedirectReadWrite:
+			return nil, &ParseError{Message: "missing input file", Pos: tok.Pos}
+		case TokenRedirectDupIn, TokenRedirectDupOut:
+			return nil, &ParseError{Message: "missing file descriptor", Pos: tok.Pos}
+		case TokenHereString:
+			return nil, &ParseError{Message: "missing here-string", Pos: tok.Pos}
+		}
+		return nil, &ParseError{Message: "missing output file", Pos: tok.Pos}
+	}
+
+	ps.pos++
+	target, err := ps.word(ps.tokens[ps.pos])
+	if err != nil {
+		return nil, err
+	}
+	return &Redirect{Op: tok.Type, Fd: redirectFd(tok), Target: target}, nil
+}
+
+// assignment parses a word token of the form NAME=value, NAME+=value,
+// NAME[index]=value or NAME=(elements), or returns nil if tok is not one.
+func (ps *parseState) assignment(tok Token) (*Assign, error) {
+	text := tok.Value
+	assign := &Assign{Name: extractVariableName(text)}
+	if assign.Name == "" {
+		return nil, nil
+	}
+	n := paramRef(text)
+	rest := text[n:]
+
+	if strings.HasPrefix(rest, "+=") {
+		assign.Append = true
+		rest = rest[1:]
+	}
+	if !strings.HasPrefix(rest, "=") {
+		return nil, nil
+	}
+	rest = rest[1:]
+
+	if n > len(assign.Name) {
+		parts, err := ps.parseParts(text[len(assign.Name)+1:n-1], "", tok.Pos)
+		if err != nil {
+			return nil, err
 		}
+		assign.Index = &Word{Parts: parts}
+	}
+
+	if assign.Index == nil && strings.HasPrefix(rest, "(") && strings.HasSuffix(rest, ")") {
+		elems, err := ps.arrayElems(rest[1:len(rest)-1], tok.Pos+len(text)-len(rest)+1)
+		if err != nil {
+			return nil, err
+		}
+		assign.Array = elems
+		return assign, nil
+	}
+
+	parts, err := ps.parseParts(rest, "", tok.Pos)
+	if err != nil {
+		return nil, err
+	}
+	assign.Value = &Word{Parts: parts}
+	return assign, nil
 }
 
-		if inQuote {
-				return nil, &ParseError{Message: "unclosed quote", Pos: len(input)}
+// arrayElems parses the words between the parentheses of an array
+// assignment found at pos. The result is never nil, so that name=()
+// still reads as an array. A subscript, as in [index]=value, may contain
+// blanks.
+func (ps *parseState) arrayElems(text string, pos int) ([]*ArrayElem, error) {
+	elems := []*ArrayElem{}
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			continue
+		case c == '#':
+			if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(text)
+			}
+			continue
+		case isMetachar(c):
+			return nil, &ParseError{Message: fmt.Sprintf("syntax error near unexpected token '%c' in array assignment", c), Pos: pos + i}
 		}
 
-		if current.Len() > 0 {
-			tokens = append(tokens, Token{Type: TokenWord, Value: current.String()})
+		elem := &ArrayElem{}
+		start := i
+		if end := closingBracket(text[i:]); end > 0 && strings.HasPrefix(text[i+end+1:], "=") {
+			parts, err := ps.parseParts(text[i+1:i+end], "", pos+i)
+			if err != nil {
+				return nil, err
+			}
+			elem.Index = &Word{Parts: parts}
+			start = i + end + 2
 		}
 
-	return tokens, nil
+		end, err := scanWord(text, start)
+		if err != nil {
+			return nil, err
+		}
+		parts, err := ps.parseParts(text[start:end], "", pos+start)
+		if err != nil {
+			return nil, err
+		}
+		elem.Value = &Word{Parts: parts}
+		elems = append(elems, elem)
+		i = end - 1
+	}
+	return elems, nil
+}
+
+// parseArray parses the text of an array assignment, "(...)", which
+// declare and the like receive as an argument.
+func (p *Parser) parseArray(text string) ([]*ArrayElem, error) {
+	ps := &parseState{parser: p, input: text}
+	return ps.arrayElems(text[1:len(text)-1], 1)
 }
 
-func (p *Parser) extractVariableName(input string) string {
-		var name strings.Builder
-		for i, c := range input {
-				if i == 0 && !isAlpha(c) {
-						return ""
-				}
-				
-				if !isAlphaNumeric(c) && c != '_' {
-						break
-				}
-		
-				name.WriteRune(c)
+// closingBracket returns the index of the ']' matching the '[' that text
+// starts with, or -1.
+func closingBracket(text string) int {
+	if !strings.HasPrefix(text, "[") {
+		return -1
+	}
+
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
 		}
-	
-		return name.String()
+	}
+	return -1
 }
 
-func isAlpha(c rune) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+func commandOrNil(cmd *Command) *Command {
+	if len(cmd.Words) == 0 && len(cmd.Redirects) == 0 && len(cmd.Assigns) == 0 {
+		return nil
+	}
+	return cmd
 }
 
-func isAlphaNumeric(c rune) bool {
-	return isAlpha(c) || (c >= '0' && c <= '9')
+func isWordToken(tok Token) bool {
+	return tok.Type == TokenWord
+}
+
+// word parses the source text of a word token into its parts.
+func (ps *parseState) word(tok Token) (*Word, error) {
+	parts, err := ps.parseParts(tok.Value, "", tok.Pos)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: parts}, nil
+}
+
+// redirectFd returns the file descriptor a redirection token applies to,
+// either given explicitly as in 2> or implied by the operator.
+func redirectFd(tok Token) int {
+	digits := strings.TrimRight(tok.Value, "<>&|-")
+	if fd, err := strconv.Atoi(digits); err == nil {
+		return fd
+	}
+
+	switch tok.Type {
+	case TokenRedirectIn, TokenRedirectReadWrite, TokenRedirectDupIn, TokenHeredoc, TokenHereString:
+		return 0
+	}
+	return 1
+}
+
+const (
+	dquoteEscapes  = "$`\"\\\n"
+	heredocEscapes = "$`\\\n"
+)
+
+// heredocWord turns a here-document body into a word. Unless the delimiter
+// was quoted, expansions are performed and a backslash escapes $, `, \ and
+// newline.
+func (ps *parseState) heredocWord(tok Token) (*Word, error) {
+	if tok.Quoted {
+		return &Word{Parts: []WordPart{&Lit{Value: tok.Value}}}, nil
+	}
+
+	parts, err := ps.parseParts(tok.Value, heredocEscapes, tok.Pos)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: parts}, nil
+}
+
+// parseParts splits text into word parts. With an empty escapable the text
+// is unquoted: quotes are recognised and a backslash quotes any character.
+// Otherwise the text is already inside double quotes or a here-document,
+// and a backslash only escapes the characters in escapable.
+func (ps *parseState) parseParts(text, escapable string, pos int) ([]WordPart, error) {
+	var parts []WordPart
+	var lit strings.Builder
+	unquoted := escapable == ""
+
+	addPart := func(part WordPart) {
+		if lit.Len() > 0 {
+			parts = append(parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+		parts = append(parts, part)
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\\' && unquoted && i+1 < len(text):
+			i++
+			if text[i] != '\n' {
+				addPart(&SglQuoted{Value: text[i : i+1]})
+			}
+
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(escapable, text[i+1]) >= 0:
+			i++
+			if text[i] != '\n' {
+				lit.WriteByte(text[i])
+			}
+
+		case c == '\'' && unquoted:
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				return nil, &ParseError{Message: "unclosed quote", Pos: pos, Incomplete: true}
+			}
+			addPart(&SglQuoted{Value: text[i+1 : i+1+end]})
+			i += end + 1
+
+		case c == '"' && unquoted:
+			end, err := findClosingDoubleQuote(text, i+1)
+			if err != nil {
+				return nil, err
+			}
+			inner, err := ps.parseParts(text[i+1:end], dquoteEscapes, pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(&DblQuoted{Parts: inner})
+			i = end
+
+		case c == '$' && i+1 < len(text) && text[i+1] == '{':
+			end, err := findClosingBrace(text, i+2)
+			if err != nil {
+				return nil, err
+			}
+			exp, err := ps.paramExp(text[i+2:end], pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(exp)
+			i = end
+
+		case c == '$' && strings.HasPrefix(text[i+1:], "((") && isArithSubst(text, i+3):
+			end, _ := findClosingParen(text, i+3)
+			expr, err := ps.arithWord(text[i+3:end], pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(&ArithExp{Expr: expr})
+			i = end + 1
+
+		case c == '$' && i+1 < len(text) && text[i+1] == '(':
+			end, err := findClosingParen(text, i+2)
+			if err != nil {
+				return nil, err
+			}
+			list, err := ps.parseNested(text[i+2:end], pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(&CmdSubst{List: list})
+			i = end
+
+		case unquoted && i == 0 && isProcSubst(text, i):
+			end, err := findClosingParen(text, i+2)
+			if err != nil {
+				return nil, err
+			}
+			list, err := ps.parseNested(text[i+2:end], pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(&ProcSubst{List: list, Output: c == '>'})
+			i = end
+
+		case c == '`':
+			end, err := findClosingBackquote(text, i+1)
+			if err != nil {
+				return nil, err
+			}
+			list, err := ps.parseNested(unescapeBackquoted(text[i+1:end]), pos)
+			if err != nil {
+				return nil, err
+			}
+			addPart(&CmdSubst{List: list})
+			i = end
+
+		case c == '$' && i+1 < len(text):
+			// Without braces a positional parameter is a single digit.
+			name := paramName(text[i+1:])
+			if name != "" && name[0] >= '0' && name[0] <= '9' {
+				name = name[:1]
+			}
+			if name == "" {
+				lit.WriteByte(c)
+				continue
+			}
+			addPart(&ParamExp{Name: name})
+			i += len(name)
+
+		default:
+			lit.WriteByte(c)
+		}
+	}
+
+	if lit.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, &Lit{Value: lit.String()})
+	}
+
+	return parts, nil
+}
+
+// isArithSubst reports whether the "$((" before start closes with "))",
+// making it an arithmetic expansion rather than a command substitution
+// that starts with a subshell.
+func isArithSubst(text string, start int) bool {
+	end, err := findClosingParen(text, start)
+	return err == nil && end+1 < len(text) && text[end+1] == ')'
+}
+
+// arithWord parses an arithmetic expression, which undergoes parameter
+// expansion, command substitution and quote removal before evaluation.
+func (ps *parseState) arithWord(text string, pos int) (*Word, error) {
+	parts, err := ps.parseParts(text, "", pos)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: parts}, nil
+}
+
+// parseNested parses the body of a command substitution found at pos.
+func (ps *parseState) parseNested(source string, pos int) (*List, error) {
+	list, err := ps.parser.Parse(source)
+	if err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErr.Pos += pos
+		}
+		return nil, err
+	}
+	return list, nil
+}
+
+// paramOps lists the ${name<op>arg} operators, longest first where one is a
+// prefix of another.
+var paramOps = []string{
+	":-", ":=", ":?", ":+", "-", "=", "?", "+",
+	"##", "#", "%%", "%", "//", "/#", "/%", "/",
+	"^^", "^", ",,", ",", ":",
+}
+
+// paramName returns the parameter name at the start of text: an
+// identifier, a positional parameter number or a special parameter.
+func paramName(text string) string {
+	if name := extractVariableName(text); name != "" {
+		return name
+	}
+
+	i := 0
+	for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		return text[:i]
+	}
+
+	if text != "" && strings.IndexByte("@*#?$!-", text[0]) >= 0 {
+		return text[:1]
+	}
+	return ""
+}
+
+// paramRef returns the length of the parameter reference, name or
+// name[index], at the start of text, or 0 if there is none.
+func paramRef(text string) int {
+	name := paramName(text)
+	if name == "" || !isName(name) || !strings.HasPrefix(text[len(name):], "[") {
+		return len(name)
+	}
+	if end := closingBracket(text[len(name):]); end > 0 {
+		return len(name) + end + 1
+	}
+	return len(name)
+}
+
+// paramExp parses the body of a ${...} expansion.
+func (ps *parseState) paramExp(text string, pos int) (*ParamExp, error) {
+	bad := &ParseError{Message: fmt.Sprintf("${%s}: bad substitution", text), Pos: pos}
+	exp := &ParamExp{}
+
+	if len(text) > 1 && (text[0] == '#' || text[0] == '!') && paramRef(text[1:]) == len(text)-1 {
+		exp.Length = text[0] == '#'
+		exp.Keys = text[0] == '!'
+		text = text[1:]
+	}
+
+	n := paramRef(text)
+	if n == 0 {
+		return nil, bad
+	}
+	exp.Name = paramName(text)
+
+	if n > len(exp.Name) {
+		parts, err := ps.parseParts(text[len(exp.Name)+1:n-1], "", pos)
+		if err != nil {
+			return nil, err
+		}
+		exp.Index = &Word{Parts: parts}
+	}
+	if exp.Keys && listSubscript(exp) == "" {
+		return nil, bad
+	}
+
+	rest := text[n:]
+	if rest == "" {
+		return exp, nil
+	}
+
+	for _, op := range paramOps {
+		if strings.HasPrefix(rest, op) {
+			exp.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if exp.Op == "" || exp.Length {
+		return nil, bad
+	}
+
+	arg, repl, hasRepl := rest, "", false
+	switch exp.Op {
+	case "/", "//", "/#", "/%":
+		arg, repl, hasRepl = splitUnescaped(rest, '/')
+	case ":":
+		arg, repl, hasRepl = splitUnescaped(rest, ':')
+		if arg == "" && !hasRepl {
+			return nil, bad
+		}
+	}
+
+	parts, err := ps.parseParts(arg, "", pos)
+	if err != nil {
+		return nil, err
+	}
+	exp.Arg = &Word{Parts: parts}
+
+	if hasRepl {
+		if parts, err = ps.parseParts(repl, "", pos); err != nil {
+			return nil, err
+		}
+		exp.Repl = &Word{Parts: parts}
+	}
+
+	return exp, nil
 }
 
-func (p *Parser) parseTokens(tokens []Token) ([]Command, error) {
-		var commands []Command
-		var currentCommand Command
-		// var err error
-
-		for i := 0; i < len(tokens); i++ {
-			token := tokens[i]
-
-			switch token.Type {
-				case TokenWord:
-					if currentCommand.Args == nil {
-							currentCommand.Args = []string{token.Value}
-					} else {
-							currentCommand.Args = append(currentCommand.Args, token.Value)
-					}
-
-			case TokenPipe:
-					if len(currentCommand.Args) == 0 {
-							return nil, &ParseError{Message: "empty command before pipe", Pos: i}
-					}
-					
-					commands = append(commands, currentCommand)
-					currentCommand = Command{}
-
-			case TokenRedirectIn:
-					if i+1 >= len(tokens) {
-							return nil, &ParseError{Message: "missing input file", Pos: i}
-					}
-					
-					i++
-					currentCommand.Stdin = tokens[i].Value
-
-			case TokenRedirectOut, TokenRedirectAppend:
-					if i+1 >= len(tokens) {
-							return nil, &ParseError{Message: "missing output file", Pos: i}
-				}
-					
-				i++
-					currentCommand.Stdout = tokens[i].Value
-					currentCommand.StdoutAppend = token.Type == TokenRedirectAppend
-
-			case TokenVariable:
-					value := os.Getenv(token.Value)
-					
-					if currentCommand.Args == nil {
-							currentCommand.Args = []string{value}
-					} else {
-							currentCommand.Args = append(currentCommand.Args, value)
-					}
-				}
-			}
-		
-			if len(currentCommand.Args) > 0 {
-				commands = append(commands, currentCommand)
-		}
-
-		return commands, nil
+// splitUnescaped splits s at the first sep that is neither escaped nor
+// inside a nested expansion.
+func splitUnescaped(s string, sep byte) (string, string, bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '{' || c == '(':
+			depth++
+		case c == '}' || c == ')':
+			depth--
+		case c == sep && depth == 0:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
 }
@@ -0,0 +1,152 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, input string) *List {
+	t.Helper()
+
+	list, err := NewParser(nil).Parse(input)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", input, err)
+	}
+	return list
+}
+
+func TestParseAndOr(t *testing.T) {
+	tests := []struct {
+		input      string
+		pipelines  []int
+		ops        []TokenType
+		background bool
+		negated    bool
+	}{
+		{"echo a", []int{1}, nil, false, false},
+		{"a | b | c", []int{3}, nil, false, false},
+		{"a && b || c", []int{1, 1, 1}, []TokenType{TokenAnd, TokenOr}, false, false},
+		{"a |\nb &&\nc", []int{2, 1}, []TokenType{TokenAnd}, false, false},
+		{"sleep 1 | cat &", []int{2}, nil, true, false},
+		{"! a | b", []int{2}, nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			list := parse(t, tt.input)
+			if len(list.Items) != 1 {
+				t.Fatalf("got %d items, want 1", len(list.Items))
+			}
+			andOr := list.Items[0]
+
+			var pipelines []int
+			for _, p := range andOr.Pipelines {
+				pipelines = append(pipelines, len(p.Commands))
+			}
+			if !equal(pipelines, tt.pipelines) {
+				t.Errorf("pipeline lengths = %v, want %v", pipelines, tt.pipelines)
+			}
+			if !equal(andOr.Ops, tt.ops) {
+				t.Errorf("ops = %v, want %v", andOr.Ops, tt.ops)
+			}
+			if andOr.Background != tt.background {
+				t.Errorf("background = %v, want %v", andOr.Background, tt.background)
+			}
+			if andOr.Pipelines[0].Negated != tt.negated {
+				t.Errorf("negated = %v, want %v", andOr.Pipelines[0].Negated, tt.negated)
+			}
+		})
+	}
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"echo a  b", "echo a  b"},
+		{"sleep 1 && echo done &", "sleep 1 && echo done"},
+		{"(( x++ )) || echo no; echo next", "(( x++ )) || echo no"},
+		{"(( x > 0 )) && echo yes", "(( x > 0 )) && echo yes"},
+		{"cat <<EOF\nbody\nEOF\necho next", "cat <<EOF\nbody\nEOF"},
+		{"cat <<EOF | wc -l\nbody\nEOF", "cat <<EOF | wc -l\nbody\nEOF"},
+		{"echo <<<word", "echo <<<word"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			list := parse(t, tt.input)
+			if got := list.Items[0].Source; got != tt.want {
+				t.Errorf("Source = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFuncSource(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"f() { echo a; }", "f() { echo a; }"},
+		{"f() (( x++ ))", "f() (( x++ ))"},
+		{"function f { (( x += 2 )); }", "function f { (( x += 2 )); }"},
+		{"f() { cat <<EOF; }\nbody\nEOF", "f() { cat <<EOF; }\nbody\nEOF"},
+		{"f() { cat <<'EOF'\n$x\nEOF\n}", "f() { cat <<'EOF'\n$x\nEOF\n}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			list := parse(t, tt.input)
+			fn, ok := list.Items[0].Pipelines[0].Commands[0].(*FuncDecl)
+			if !ok {
+				t.Fatalf("got %T, want *FuncDecl", list.Items[0].Pipelines[0].Commands[0])
+			}
+			if fn.Source != tt.want {
+				t.Errorf("Source = %q, want %q", fn.Source, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input      string
+		want       string
+		incomplete bool
+	}{
+		{"echo ${x:}", "bad substitution", false},
+		{"echo ${x", "unclosed parameter expansion", true},
+		{"echo 'a", "unclosed quote", true},
+		{"cat <<EOF\nbody", "not terminated", true},
+		{"a &&", "", true},
+		{"a ;; b", "unexpected token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := NewParser(nil).Parse(tt.input)
+			if err == nil {
+				t.Fatalf("Parse(%q) succeeded", tt.input)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+			if isIncomplete(err) != tt.incomplete {
+				t.Errorf("incomplete = %v, want %v", isIncomplete(err), tt.incomplete)
+			}
+		})
+	}
+}
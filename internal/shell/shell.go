@@ -3,10 +3,13 @@ package shell
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -15,6 +18,7 @@ import (
 	"gosh/internal/completion"
 	"gosh/internal/config"
 	"gosh/internal/history"
+	"gosh/internal/job"
 	"gosh/internal/plugins"
 )
 
@@ -25,6 +29,7 @@ type Shell struct {
 	completion *completion.Manager
 	parser     *Parser
 	executor   *Executor
+	jobs       *job.Manager
 	workDir    string
 	
 	processGroup sync.Map
@@ -33,6 +38,27 @@ type Shell struct {
 	
 	interactive bool
 	lastExitCode int
+	shopts       map[string]bool
+	setopts      map[string]bool
+	loopDepth    int
+	callDepth    int
+	functions    map[string]*FuncDecl
+	params       []string
+	vars         map[string]*Variable
+	locals       []map[string]*Variable
+
+	// Special parameters: $$, $! and $_.
+	pid       int
+	lastBgPid int
+	lastArg   string
+
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+
+	// fds holds the descriptors above 2 that redirections on a compound
+	// command or function opened, for the commands run inside it.
+	fds map[int]*os.File
 }
 
 type ShellOption func(*Shell) error
@@ -56,6 +82,15 @@ func NewShell(opts ...ShellOption) (*Shell, error) {
 			sigChan:     make(chan os.Signal, 1),
 			stopChan:    make(chan struct{}),
 			interactive: true,
+			shopts:      map[string]bool{"extglob": true},
+			setopts:     make(map[string]bool),
+			functions:   make(map[string]*FuncDecl),
+			vars:        importEnviron(os.Environ()),
+			jobs:        job.NewManager(),
+			pid:         os.Getpid(),
+			stdin:       os.Stdin,
+			stdout:      os.Stdout,
+			stderr:      os.Stderr,
 	}
 
 		s.history, err = history.NewManager(cfg.HistoryFile)
@@ -81,7 +116,9 @@ func NewShell(opts ...ShellOption) (*Shell, error) {
 }
 
 func (s *Shell) Start() error {
-	signal.Notify(s.sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// SIGTSTP is caught and ignored so that ^Z at the prompt does not
+	// stop the shell, while commands it starts get the default action.
+	signal.Notify(s.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGTSTP)
 	go s.handleSignals()
 
 	if err := s.initialize(); err != nil {
@@ -101,6 +138,9 @@ func (s *Shell) handleSignals() {
 					fmt.Print(s.getPrompt())
 			case syscall.SIGTERM:
 					s.Stop()
+			case syscall.SIGHUP:
+					s.hangupJobs()
+					s.Stop()
 			}
 	}
 }
@@ -139,9 +179,10 @@ func (s *Shell) initializeEnvironment() error {
 	}
 
 	for k, v := range env {
-			if err := os.Setenv(k, v); err != nil {
+			if err := s.setVar(k, v); err != nil {
 					return fmt.Errorf("failed to set env %s: %w", k, err)
 			}
+			s.exportVar(k, true)
 	}
 	
 	return nil
@@ -167,9 +208,8 @@ func (s *Shell) loop() error {
 			case <-s.stopChan:
 					return nil
 			default:
-					fmt.Print(s.getPrompt())
-					
-					input, err := reader.ReadString('\n')
+					s.notifyJobs()
+					input, err := s.readCommand(reader)
 					if err != nil {
 							if err == io.EOF {
 									return nil
@@ -177,8 +217,7 @@ func (s *Shell) loop() error {
 							return err
 					}
 
-					input = strings.TrimSpace(input)
-					if input == "" {
+					if strings.TrimSpace(input) == "" {
 							continue
 					}
 
@@ -189,29 +228,64 @@ func (s *Shell) loop() error {
 	}
 }
 
+// readCommand reads lines until they form a complete command, showing a
+// continuation prompt while a quote, here-document or operator is open.
+func (s *Shell) readCommand(reader *bufio.Reader) (string, error) {
+	var input strings.Builder
+	prompt := s.getPrompt()
+
+	for {
+		fmt.Print(prompt)
+
+		line, err := reader.ReadString('\n')
+		input.WriteString(line)
+		if err != nil {
+			if err == io.EOF && input.Len() > 0 {
+				return input.String(), nil
+			}
+			return "", err
+		}
+
+		if _, err := s.parser.Parse(input.String()); !isIncomplete(err) {
+			return input.String(), nil
+		}
+		prompt = "> "
+	}
+}
+
 func (s *Shell) Execute(input string) error {
 	s.history.Add(input)
 
-	commands, err := s.parser.Parse(input)
+	err := s.run(input)
+
+	var exit *exitControl
+	if errors.As(err, &exit) {
+		s.Stop()
+		os.Exit(exit.Status)
+	}
+	return err
+}
+
+func (s *Shell) run(input string) error {
+	list, err := s.parser.Parse(input)
 	
 	if err != nil {
 			return err
 	}
 
-	for _, cmd := range commands {
-			if builtin, ok := builtinCommands[cmd.Args[0]]; ok {
-					if err := builtin.Execute(s, cmd.Args); err != nil {
-							return err
-					}
-					continue
-			}
+	return s.runList(context.Background(), list)
+}
 
-			if err := s.executor.Execute(context.Background(), []Command{cmd}); err != nil {
-					return err
-			}
-	}
+func (s *Shell) GetAliases() map[string]string {
+	return s.aliases.GetAll()
+}
 
-	return nil
+func (s *Shell) GetHistory() []string {
+	return s.history.GetAll()
+}
+
+func (s *Shell) GetWorkDir() string {
+	return s.workDir
 }
 
 // func (s *Shell) setupSignalHandling() {
@@ -257,3 +331,58 @@ func (s *Shell) loadPlugins() error {
 	pluginManager := plugins.NewManager(s.config.PluginsDir)
 	return pluginManager.LoadPlugins()
 }
+
+// subshell returns a copy of s for running a subshell or command
+// substitution. Its working directory, variables, options, functions and
+// parameters are its own; history, aliases and configuration are shared.
+func (s *Shell) subshell() *Shell {
+	sub := &Shell{
+		config:       s.config,
+		history:      s.history,
+		aliases:      s.aliases,
+		completion:   s.completion,
+		workDir:      s.workDir,
+		sigChan:      s.sigChan,
+		stopChan:     s.stopChan,
+		lastExitCode: s.lastExitCode,
+		shopts:       make(map[string]bool, len(s.shopts)),
+		setopts:      maps.Clone(s.setopts),
+		loopDepth:    s.loopDepth,
+		callDepth:    s.callDepth,
+		functions:    make(map[string]*FuncDecl, len(s.functions)),
+		params:       s.params,
+		vars:         copyVars(s.vars),
+		jobs:         job.NewManager(),
+		pid:          s.pid,
+		lastBgPid:    s.lastBgPid,
+		lastArg:      s.lastArg,
+		stdin:        s.stdin,
+		stdout:       s.stdout,
+		stderr:       s.stderr,
+		fds:          maps.Clone(s.fds),
+	}
+
+	for name, on := range s.shopts {
+		sub.shopts[name] = on
+	}
+	for name, fn := range s.functions {
+		sub.functions[name] = fn
+	}
+	for _, scope := range s.locals {
+		sub.locals = append(sub.locals, copyVars(scope))
+	}
+
+	sub.parser = NewParser(sub)
+	sub.executor = NewExecutor(sub)
+	sub.executor.group = s.executor.group
+	return sub
+}
+
+// resolvePath makes path absolute relative to the shell's working
+// directory, which is not the process's.
+func (s *Shell) resolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.workDir, path)
+}
@@ -0,0 +1,80 @@
+package shell
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestShell returns a non-interactive shell whose configuration and
+// history live in a temporary home directory and whose working directory is
+// a temporary directory of its own.
+func newTestShell(t *testing.T) *Shell {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	s, err := NewShell()
+	if err != nil {
+		t.Fatalf("NewShell: %v", err)
+	}
+	s.interactive = false
+	s.workDir = t.TempDir()
+	return s
+}
+
+// runScript runs script in s with stdout and stderr going to a file, and
+// returns what was written to them, the exit status and the error run
+// returned.
+func runScript(t *testing.T, s *Shell, script string) (string, int, error) {
+	t.Helper()
+
+	out, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	stdout, stderr := s.stdout, s.stderr
+	s.stdout, s.stderr = out, out
+	defer func() { s.stdout, s.stderr = stdout, stderr }()
+
+	runErr := s.run(script)
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), s.lastExitCode, runErr
+}
+
+type scriptTest struct {
+	name   string
+	script string
+	want   string
+	err    string
+	status int
+}
+
+// runScriptTests runs each script in a fresh shell and compares its output,
+// the error it failed with, if any, and its exit status.
+func runScriptTests(t *testing.T, tests []scriptTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestShell(t)
+			got, status, err := runScript(t, s, tt.script)
+
+			if got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("error = %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want one containing %q", err, tt.err)
+			case tt.err == "" && status != tt.status:
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package shell
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Variable is a shell variable. Only exported variables are passed to the
+// environment of commands. Unset marks a variable that was given
+// attributes, as by export or readonly, but no value; it expands as unset.
+type Variable struct {
+	Value    string
+	Exported bool
+	ReadOnly bool
+	Unset    bool
+
+	// Array holds the elements of an indexed array and Assoc those of an
+	// associative array. Value is unused once a variable is either.
+	Array map[int]string
+	Assoc map[string]string
+}
+
+// element is an element of an array. Index orders the elements; for an
+// associative array it is the position of Key among the sorted keys.
+type element struct {
+	Index int
+	Key   string
+	Value string
+}
+
+func (v *Variable) isArray() bool {
+	return v.Array != nil || v.Assoc != nil
+}
+
+// scalar returns the value of v used without a subscript, which for an
+// array is its element 0.
+func (v *Variable) scalar() (string, bool) {
+	switch {
+	case v.Array != nil:
+		value, ok := v.Array[0]
+		return value, ok
+	case v.Assoc != nil:
+		value, ok := v.Assoc["0"]
+		return value, ok
+	}
+	return v.Value, !v.Unset
+}
+
+// elements returns the elements of v in order. A scalar is an array with
+// a single element at index 0.
+func (v *Variable) elements() []element {
+	switch {
+	case v.Array != nil:
+		indices := make([]int, 0, len(v.Array))
+		for i := range v.Array {
+			indices = append(indices, i)
+		}
+		sort.Ints(indices)
+
+		elems := make([]element, len(indices))
+		for n, i := range indices {
+			elems[n] = element{Index: i, Key: strconv.Itoa(i), Value: v.Array[i]}
+		}
+		return elems
+
+	case v.Assoc != nil:
+		keys := make([]string, 0, len(v.Assoc))
+		for key := range v.Assoc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		elems := make([]element, len(keys))
+		for n, key := range keys {
+			elems[n] = element{Index: n, Key: key, Value: v.Assoc[key]}
+		}
+		return elems
+	}
+
+	if v.Unset {
+		return nil
+	}
+	return []element{{Key: "0", Value: v.Value}}
+}
+
+// nextIndex returns the index following the last element of an indexed
+// array.
+func (v *Variable) nextIndex() int {
+	next := 0
+	for i := range v.Array {
+		next = max(next, i+1)
+	}
+	return next
+}
+
+// importEnviron creates an exported variable for every entry of env.
+func importEnviron(env []string) map[string]*Variable {
+	vars := make(map[string]*Variable, len(env))
+	for _, kv := range env {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && isName(name) {
+			vars[name] = &Variable{Value: value, Exported: true}
+		}
+	}
+	return vars
+}
+
+// copyVars returns a deep copy of vars, for a subshell.
+func copyVars(vars map[string]*Variable) map[string]*Variable {
+	copied := make(map[string]*Variable, len(vars))
+	for name, v := range vars {
+		if v != nil {
+			dup := *v
+			if v.Array != nil {
+				dup.Array = maps.Clone(v.Array)
+			}
+			if v.Assoc != nil {
+				dup.Assoc = maps.Clone(v.Assoc)
+			}
+			v = &dup
+		}
+		copied[name] = v
+	}
+	return copied
+}
+
+func (s *Shell) lookupVar(name string) (string, bool) {
+	v, ok := s.vars[name]
+	if !ok {
+		return "", false
+	}
+	return v.scalar()
+}
+
+// setVar sets a variable, or element 0 of an array.
+func (s *Shell) setVar(name, value string) error {
+	v, ok := s.vars[name]
+	if !ok {
+		s.vars[name] = &Variable{Value: value}
+		return nil
+	}
+	if v.ReadOnly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+
+	switch {
+	case v.Array != nil:
+		v.Array[0] = value
+	case v.Assoc != nil:
+		v.Assoc["0"] = value
+	default:
+		v.Value = value
+		v.Unset = false
+	}
+	return nil
+}
+
+// lookupElem returns the element of name at subscript sub, which is an
+// arithmetic expression unless name is an associative array.
+func (s *Shell) lookupElem(name, sub string) (string, bool, error) {
+	v, ok := s.vars[name]
+	if !ok {
+		return "", false, nil
+	}
+	if v.Assoc != nil {
+		value, ok := v.Assoc[sub]
+		return value, ok, nil
+	}
+
+	i, err := s.arrayIndex(v, sub)
+	if err != nil {
+		return "", false, err
+	}
+	if v.Array == nil {
+		return v.Value, i == 0, nil
+	}
+	value, ok := v.Array[i]
+	return value, ok, nil
+}
+
+// arrayIndex evaluates the subscript of an indexed array. A negative index
+// counts back from the end of v.
+func (s *Shell) arrayIndex(v *Variable, sub string) (int, error) {
+	n, err := s.arith(sub)
+	if err != nil {
+		return 0, err
+	}
+
+	i := int(n)
+	if i < 0 && v != nil {
+		if v.Array != nil {
+			i += v.nextIndex()
+		} else {
+			i++
+		}
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("%s: bad array subscript", sub)
+	}
+	return i, nil
+}
+
+// arrayVar returns name for assigning elements to. A variable that does
+// not exist becomes an indexed array, and so does a scalar, with its value
+// as element 0.
+func (s *Shell) arrayVar(name string) (*Variable, error) {
+	v, ok := s.vars[name]
+	switch {
+	case !ok:
+		v = &Variable{Array: map[int]string{}}
+		s.vars[name] = v
+	case v.ReadOnly:
+		return nil, fmt.Errorf("%s: readonly variable", name)
+	case v.Unset:
+		v.Array = map[int]string{}
+		v.Unset = false
+	case !v.isArray():
+		v.Array = map[int]string{0: v.Value}
+		v.Value = ""
+	}
+	return v, nil
+}
+
+// declareArray gives name the kind of array declare -a or -A asks for.
+func (s *Shell) declareArray(name string, assoc bool) error {
+	v, ok := s.vars[name]
+	switch {
+	case !ok:
+		v = &Variable{Unset: true}
+		s.vars[name] = v
+	case assoc && v.Array != nil:
+		return fmt.Errorf("%s: cannot convert indexed to associative array", name)
+	case !assoc && v.Assoc != nil:
+		return fmt.Errorf("%s: cannot convert associative to indexed array", name)
+	case v.isArray():
+		return nil
+	case v.ReadOnly:
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+
+	if assoc {
+		v.Assoc = map[string]string{}
+		if !v.Unset {
+			v.Assoc["0"] = v.Value
+		}
+	} else {
+		v.Array = map[int]string{}
+		if !v.Unset {
+			v.Array[0] = v.Value
+		}
+	}
+	v.Value = ""
+	v.Unset = false
+	return nil
+}
+
+// setElem sets the element of name at subscript sub, appending to it for
+// +=.
+func (s *Shell) setElem(name, sub, value string, appendTo bool) error {
+	if v, ok := s.vars[name]; ok && v.Assoc != nil {
+		if v.ReadOnly {
+			return fmt.Errorf("%s: readonly variable", name)
+		}
+		if appendTo {
+			value = v.Assoc[sub] + value
+		}
+		v.Assoc[sub] = value
+		return nil
+	}
+
+	i, err := s.arrayIndex(s.vars[name], sub)
+	if err != nil {
+		return err
+	}
+	v, err := s.arrayVar(name)
+	if err != nil {
+		return err
+	}
+	if appendTo {
+		value = v.Array[i] + value
+	}
+	v.Array[i] = value
+	return nil
+}
+
+// setArray performs name=(...) or name+=(...). Every element is expanded
+// before the array changes, so that the elements may refer to it.
+func (s *Shell) setArray(name string, elems []*ArrayElem, appendTo bool) error {
+	type entry struct {
+		sub     string
+		indexed bool
+		value   string
+	}
+
+	var entries []entry
+	for _, elem := range elems {
+		if elem.Index == nil {
+			values, err := s.expandWords([]*Word{elem.Value})
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				entries = append(entries, entry{value: value})
+			}
+			continue
+		}
+
+		sub, err := s.expandWord(elem.Index)
+		if err != nil {
+			return err
+		}
+		value, err := s.expandWord(elem.Value)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{sub: sub, indexed: true, value: value})
+	}
+
+	v, err := s.arrayVar(name)
+	if err != nil {
+		return err
+	}
+
+	if v.Assoc != nil {
+		if !appendTo {
+			v.Assoc = map[string]string{}
+		}
+		for _, e := range entries {
+			if !e.indexed {
+				return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, e.value)
+			}
+			v.Assoc[e.sub] = e.value
+		}
+		return nil
+	}
+
+	if !appendTo {
+		v.Array = map[int]string{}
+	}
+	next := v.nextIndex()
+	for _, e := range entries {
+		if e.indexed {
+			if next, err = s.arrayIndex(v, e.sub); err != nil {
+				return err
+			}
+		}
+		v.Array[next] = e.value
+		next++
+	}
+	return nil
+}
+
+// unsetElem removes the element of name at subscript sub.
+func (s *Shell) unsetElem(name, sub string) error {
+	v, ok := s.vars[name]
+	if !ok {
+		return nil
+	}
+	if v.ReadOnly {
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+
+	if v.Assoc != nil {
+		delete(v.Assoc, sub)
+		return nil
+	}
+
+	i, err := s.arrayIndex(v, sub)
+	if err != nil {
+		return err
+	}
+	if v.Array != nil {
+		delete(v.Array, i)
+	} else if i == 0 {
+		delete(s.vars, name)
+	}
+	return nil
+}
+
+// setPipeStatus records the statuses of the stages of the last pipeline
+// in the PIPESTATUS array.
+func (s *Shell) setPipeStatus(statuses []int) {
+	v := &Variable{Array: make(map[int]string, len(statuses))}
+	for i, status := range statuses {
+		v.Array[i] = strconv.Itoa(status)
+	}
+	s.vars["PIPESTATUS"] = v
+}
+
+func (s *Shell) unsetVar(name string) error {
+	if v, ok := s.vars[name]; ok && v.ReadOnly {
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+	delete(s.vars, name)
+	return nil
+}
+
+// exportVar marks name for export. A name that does not exist is exported
+// without a value, and only enters the environment once it is set.
+func (s *Shell) exportVar(name string, exported bool) {
+	v, ok := s.vars[name]
+	if !ok {
+		v = &Variable{Unset: true}
+		s.vars[name] = v
+	}
+	v.Exported = exported
+}
+
+// environ returns the environment for a command: every exported variable
+// in name order, followed by extra NAME=value entries, which win.
+func (s *Shell) environ(extra []string) []string {
+	env := make([]string, 0, len(s.vars)+len(extra))
+	for name, v := range s.vars {
+		if v.Exported && !v.isArray() && !v.Unset {
+			env = append(env, name+"="+v.Value)
+		}
+	}
+	sort.Strings(env)
+	return append(env, extra...)
+}
+
+// varNames returns the names of the variables for which keep is true, in
+// order.
+func (s *Shell) varNames(keep func(*Variable) bool) []string {
+	var names []string
+	for name, v := range s.vars {
+		if keep(v) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declaration formats a variable the way declare -p prints it.
+func (s *Shell) declaration(name string) string {
+	v := s.vars[name]
+
+	flags := ""
+	if v.Array != nil {
+		flags += "a"
+	}
+	if v.Assoc != nil {
+		flags += "A"
+	}
+	if v.ReadOnly {
+		flags += "r"
+	}
+	if v.Exported {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+
+	if v.Unset {
+		return fmt.Sprintf("declare -%s %s", flags, name)
+	}
+	if !v.isArray() {
+		return fmt.Sprintf("declare -%s %s=%s", flags, name, quoteValue(v.Value))
+	}
+
+	elems := v.elements()
+	items := make([]string, len(elems))
+	for i, e := range elems {
+		key := e.Key
+		if v.Assoc != nil && (key == "" || strings.ContainsFunc(key, func(r rune) bool { return !isAlphaNumeric(r) && r != '_' })) {
+			key = quoteValue(key)
+		}
+		items[i] = fmt.Sprintf("[%s]=%s", key, quoteValue(e.Value))
+	}
+	return fmt.Sprintf("declare -%s %s=(%s)", flags, name, strings.Join(items, " "))
+}
+
+// quoteValue double-quotes value so that the shell reads it back unchanged.
+func quoteValue(value string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if strings.IndexByte("\"\\$`", value[i]) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(value[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// splitAssignment splits a word of the form name=value, with name unquoted,
+// into the name and the word for the value. The name may carry a subscript
+// and the + of +=.
+func splitAssignment(word *Word) (string, *Word, bool) {
+	if len(word.Parts) == 0 {
+		return "", nil, false
+	}
+	lit, ok := word.Parts[0].(*Lit)
+	if !ok {
+		return "", nil, false
+	}
+	name, rest, found := strings.Cut(lit.Value, "=")
+	target := strings.TrimSuffix(name, "+")
+	if !found || !isName(paramName(target)) || paramRef(target) != len(target) {
+		return "", nil, false
+	}
+
+	value := &Word{}
+	if rest != "" || len(word.Parts) == 1 {
+		value.Parts = append(value.Parts, &Lit{Value: rest})
+	}
+	value.Parts = append(value.Parts, word.Parts[1:]...)
+	return name, value, true
+}
+
+// expandAssigns expands the values of assignments into NAME=value form,
+// for the environment of a command. Arrays cannot be exported, so array
+// assignments are left out. Assigning to a readonly variable is an error.
+func (s *Shell) expandAssigns(assigns []*Assign) ([]string, error) {
+	env := make([]string, 0, len(assigns))
+	for _, a := range assigns {
+		if v, ok := s.vars[a.Name]; ok && v.ReadOnly {
+			return nil, fmt.Errorf("%s: readonly variable", a.Name)
+		}
+		if a.Array != nil || a.Index != nil {
+			continue
+		}
+
+		value, err := s.expandWord(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		if a.Append {
+			old, _ := s.lookupVar(a.Name)
+			value = old + value
+		}
+		env = append(env, a.Name+"="+value)
+	}
+	return env, nil
+}
+
+// assign performs an assignment in the shell.
+func (s *Shell) assign(a *Assign) error {
+	if a.Array != nil {
+		return s.setArray(a.Name, a.Array, a.Append)
+	}
+
+	value, err := s.expandWord(a.Value)
+	if err != nil {
+		return err
+	}
+
+	if a.Index != nil {
+		sub, err := s.expandWord(a.Index)
+		if err != nil {
+			return err
+		}
+		return s.setElem(a.Name, sub, value, a.Append)
+	}
+
+	if a.Append {
+		old, _ := s.lookupVar(a.Name)
+		value = old + value
+	}
+	return s.setVar(a.Name, value)
+}
+
+// withTempVars runs fn with the NAME=value assignments in env exported for
+// its duration, as for "VAR=val fn" with a function or builtin.
+func (s *Shell) withTempVars(env []string, fn func() error) error {
+	saved := make(map[string]*Variable, len(env))
+	defer func() {
+		for name, old := range saved {
+			if old == nil {
+				delete(s.vars, name)
+			} else {
+				s.vars[name] = old
+			}
+		}
+	}()
+
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if old, ok := s.vars[name]; ok && old.ReadOnly {
+			return fmt.Errorf("%s: readonly variable", name)
+		}
+		if _, ok := saved[name]; !ok {
+			saved[name] = s.vars[name]
+		}
+		s.vars[name] = &Variable{Value: value, Exported: true}
+	}
+
+	return fn()
+}
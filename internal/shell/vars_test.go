@@ -0,0 +1,22 @@
+package shell
+
+import "testing"
+
+func TestVariables(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{name: "assignment", script: "x=1 y=$x; echo $x $y", want: "1 1\n"},
+		{name: "not exported", script: "x=1; env | grep -c ^x=", want: "0\n", status: 1},
+		{name: "export", script: "export x=1; env | grep ^x=", want: "x=1\n"},
+		{name: "unset", script: "x=1; unset x; echo ${x-unset}", want: "unset\n"},
+		{name: "readonly", script: "readonly R=1; R=2", want: "Error: R: readonly variable\n", status: 1},
+		{name: "exported unset", script: "unset V; export V; echo ${V-unset}", want: "unset\n"},
+		{name: "exported unset not in environment", script: "unset V; export V; env | grep -c ^V=", want: "0\n", status: 1},
+		{name: "exported then set", script: "unset V; export V; V=1; env | grep ^V=", want: "V=1\n"},
+		{name: "declare unset", script: "unset V; export V; declare -p V", want: "declare -x V\n"},
+		{name: "readonly unset", script: "unset R; readonly R; echo ${R-unset}", want: "unset\n"},
+		{name: "prefix assignment", script: "V=1 env | grep ^V=", want: "V=1\n"},
+		{name: "prefix assignment is temporary", script: "V=1 true; echo ${V-unset}", want: "unset\n"},
+		{name: "prefix assignment to readonly", script: "readonly R=1; R=2 env", want: "Error: R: readonly variable\n", status: 1},
+		{name: "prefix assignment to readonly builtin", script: "readonly R=1; R=2 echo hi", want: "Error: R: readonly variable\n", status: 1},
+	})
+}